@@ -0,0 +1,231 @@
+package wireproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// accountingSaveInterval is how often the usage counters are written to the state file
+const accountingSaveInterval = time.Minute
+
+// UserUsage counts the bytes transferred by a user in both directions
+type UserUsage struct {
+	Total   int64 `json:"total"`
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+	// Day and Month are the periods Daily and Monthly were counted in
+	Day   string `json:"day"`
+	Month string `json:"month"`
+}
+
+// roll starts over the counters of the periods which ended before `now`
+func (u *UserUsage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day = day
+		u.Daily = 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month = month
+		u.Monthly = 0
+	}
+}
+
+// Accounting keeps the usage of authenticated users, optionally persisted to a state file
+type Accounting struct {
+	lock   sync.Mutex
+	path   string
+	users  map[string]*UserUsage
+	dirty  bool
+	logger *device.Logger
+}
+
+// NewAccounting loads the usage stored in the state file at `path`. The usage
+// is only kept in memory if `path` is empty.
+func NewAccounting(path string, logger *device.Logger) (*Accounting, error) {
+	a := &Accounting{path: path, users: make(map[string]*UserUsage), logger: logger}
+	if path == "" {
+		return a, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.users); err != nil {
+		return nil, errors.New("invalid accounting state file " + path + ": " + err.Error())
+	}
+	return a, nil
+}
+
+// usage returns the rolled over usage of `user`, the lock must be held
+func (a *Accounting) usage(user string) *UserUsage {
+	usage, ok := a.users[user]
+	if !ok {
+		usage = &UserUsage{}
+		a.users[user] = usage
+	}
+	usage.roll(time.Now())
+	return usage
+}
+
+// Add counts `n` bytes transferred by `user`
+func (a *Accounting) Add(user string, n int64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	usage := a.usage(user)
+	usage.Total += n
+	usage.Daily += n
+	usage.Monthly += n
+	a.dirty = true
+}
+
+// Exceeded checks whether `user` used up any of its quotas
+func (a *Accounting) Exceeded(user string, quota Quota) bool {
+	if quota == (Quota{}) {
+		return false
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	usage := a.usage(user)
+	return (quota.DailyQuota > 0 && usage.Daily >= quota.DailyQuota) ||
+		(quota.MonthlyQuota > 0 && usage.Monthly >= quota.MonthlyQuota)
+}
+
+// Save writes the usage to the state file if it changed since it was last saved
+func (a *Accounting) Save() error {
+	if a.path == "" {
+		return nil
+	}
+
+	a.lock.Lock()
+	if !a.dirty {
+		a.lock.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(a.users, "", "  ")
+	a.dirty = false
+	a.lock.Unlock()
+	if err == nil {
+		err = a.write(data)
+	}
+	if err != nil {
+		// keep the usage pending, so it is written by the next attempt
+		a.lock.Lock()
+		a.dirty = true
+		a.lock.Unlock()
+	}
+	return err
+}
+
+// write replaces the state file with `data`
+func (a *Accounting) write(data []byte) error {
+	// write to a temporary file first, so the state file is never left half written
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), a.path)
+}
+
+// StartSaving periodically writes the usage to the state file until `done` is closed
+func (a *Accounting) StartSaving(done <-chan struct{}) {
+	if a.path == "" {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(accountingSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := a.Save(); err != nil {
+				a.logger.Errorf("Failed to save accounting state: %s", err.Error())
+			}
+		}
+	}()
+}
+
+// ServeHTTP reports the usage of every user as JSON
+func (a *Accounting) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	a.lock.Lock()
+	now := time.Now()
+	for _, usage := range a.users {
+		usage.roll(now)
+	}
+	body, err := json.Marshal(a.users)
+	a.lock.Unlock()
+	if err != nil {
+		a.logger.Errorf("Failed to get accounting: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+	_, _ = w.Write([]byte("\n"))
+}
+
+// accountedConn counts the bytes going through a connection towards the usage of a user
+type accountedConn struct {
+	io.ReadWriteCloser
+	accounting *Accounting
+	user       string
+}
+
+func (c *accountedConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.accounting.Add(c.user, int64(n))
+	}
+	return n, err
+}
+
+func (c *accountedConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.accounting.Add(c.user, int64(n))
+	}
+	return n, err
+}
+
+func (c *accountedConn) CloseWrite() error {
+	return closeWrite(c.ReadWriteCloser, c)
+}
+
+// account wraps `conn` so that its traffic counts towards the usage of `user`.
+// Connections of anonymous users are not accounted.
+func (a *Accounting) account(conn io.ReadWriteCloser, user string) io.ReadWriteCloser {
+	if a == nil || user == "" {
+		return conn
+	}
+	return &accountedConn{ReadWriteCloser: conn, accounting: a, user: user}
+}
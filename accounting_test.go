@@ -0,0 +1,41 @@
+package wireproxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccountingSaveRetries(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	path := filepath.Join(dir, "usage.json")
+	accounting, err := NewAccounting(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounting.Add("alice", 42)
+
+	// the directory of the state file does not exist yet
+	if err := accounting.Save(); err == nil {
+		t.Fatal("expected saving to a missing directory to fail")
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounting.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected the usage to be written once saving succeeds: %v", err)
+	}
+	var users map[string]*UserUsage
+	if err := json.Unmarshal(data, &users); err != nil {
+		t.Fatal(err)
+	}
+	if usage := users["alice"]; usage == nil || usage.Total != 42 {
+		t.Errorf("unexpected usage %s", data)
+	}
+}
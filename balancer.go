@@ -0,0 +1,163 @@
+package wireproxy
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// Policies picking the target of a connection of a tunnel with several targets
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceRandom           = "random"
+	BalanceLeastConnections = "least-connections"
+	BalanceFailover         = "failover"
+)
+
+// defaultHealthCheckTimeout is how long the connection of a health check may take by default
+const defaultHealthCheckTimeout = 5 * time.Second
+
+// backend is a target of a tunnel
+type backend struct {
+	target      string
+	address     *addressPort
+	healthy     atomic.Bool
+	connections atomic.Int64
+}
+
+// balancer picks the target of each connection of a tunnel
+type balancer struct {
+	backends []*backend
+	policy   string
+	dial     func(ctx context.Context, address *addressPort) (net.Conn, error)
+	next     atomic.Uint64
+	// timeout bounds each connection to a target, including those of health checks
+	timeout time.Duration
+}
+
+// newBalancer creates a balancer between the targets of `lb`, or `target` when it has none.
+// `dial` connects to a target.
+func newBalancer(target string, lb LoadBalancing, dial func(ctx context.Context, address *addressPort) (net.Conn, error)) (*balancer, error) {
+	targets := lb.Targets
+	if len(targets) == 0 {
+		targets = []string{target}
+	}
+
+	b := &balancer{policy: lb.Balance, dial: dial, timeout: time.Duration(lb.HealthCheckTimeout) * time.Second}
+	if b.timeout == 0 {
+		b.timeout = defaultHealthCheckTimeout
+	}
+	for _, target := range targets {
+		address, err := parseAddressPort(target)
+		if err != nil {
+			return nil, err
+		}
+		backend := &backend{target: target, address: address}
+		backend.healthy.Store(true)
+		b.backends = append(b.backends, backend)
+	}
+	return b, nil
+}
+
+// order lists the backends to try for a new connection, the healthy ones first in the
+// order given by the policy
+func (b *balancer) order() []*backend {
+	var healthy, unhealthy []*backend
+	for _, backend := range b.backends {
+		if backend.healthy.Load() {
+			healthy = append(healthy, backend)
+		} else {
+			unhealthy = append(unhealthy, backend)
+		}
+	}
+
+	if len(healthy) > 1 {
+		switch b.policy {
+		case BalanceRandom:
+			healthy = rotate(healthy, rand.Intn(len(healthy)))
+		case BalanceLeastConnections:
+			slices.SortStableFunc(healthy, func(a, b *backend) int {
+				return int(a.connections.Load() - b.connections.Load())
+			})
+		case BalanceFailover:
+		default:
+			healthy = rotate(healthy, int((b.next.Add(1)-1)%uint64(len(healthy))))
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// rotate moves the first `n` backends to the end
+func rotate(backends []*backend, n int) []*backend {
+	rotated := make([]*backend, 0, len(backends))
+	rotated = append(rotated, backends[n:]...)
+	return append(rotated, backends[:n]...)
+}
+
+// connect connects to the first target accepting the connection, and returns the function
+// to call once the connection is closed. Targets which fail are marked unhealthy.
+func (b *balancer) connect(ctx context.Context) (net.Conn, func(), error) {
+	var err error
+	for _, backend := range b.order() {
+		var conn net.Conn
+		conn, err = b.dialTimeout(ctx, backend.address)
+		if err != nil {
+			if ctx.Err() == nil {
+				backend.healthy.Store(false)
+			}
+			continue
+		}
+		backend.healthy.Store(true)
+		backend.connections.Add(1)
+		return conn, func() { backend.connections.Add(-1) }, nil
+	}
+	return nil, nil, err
+}
+
+// dialTimeout connects to `address`, giving up after the timeout of the balancer
+func (b *balancer) dialTimeout(ctx context.Context, address *addressPort) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	return b.dial(ctx, address)
+}
+
+// checkHealth connects to every target every `interval` until `ctx` is done. Targets which
+// can't be reached are only tried once every healthy target failed.
+func (b *balancer) checkHealth(ctx context.Context, interval time.Duration, logger *device.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, target := range b.backends {
+			wg.Add(1)
+			go func(target *backend) {
+				defer wg.Done()
+				conn, err := b.dialTimeout(ctx, target.address)
+				if err == nil {
+					_ = conn.Close()
+				}
+				if healthy := err == nil; target.healthy.Swap(healthy) != healthy && ctx.Err() == nil {
+					if healthy {
+						logger.Verbosef("Target %s is healthy again", target.target)
+					} else {
+						logger.Errorf("Target %s failed its health check: %s", target.target, err.Error())
+					}
+				}
+			}(target)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package wireproxy
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// bridgeTUN multiplexes the netstack device and a host TUN device onto a single
+// wireguard device. Packets from wireguard are dispatched by destination address:
+// those addressed to the host TUN go there, everything else goes to netstack.
+type bridgeTUN struct {
+	tun.Device
+
+	host      tun.Device
+	hostAddrs []netip.Addr
+
+	packets   chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	logger    *device.Logger
+}
+
+// openHostTUN creates the host TUN device, or adopts the one passed down by a parent process
+func openHostTUN(conf *TUNConfig, mtu int) (tun.Device, error) {
+	if conf.FD != nil {
+		return openTUNFromFD(*conf.FD, mtu)
+	}
+	return tun.CreateTUN(conf.Name, mtu)
+}
+
+func newBridgeTUN(netstack tun.Device, host tun.Device, hostAddrs []netip.Addr, logger *device.Logger) *bridgeTUN {
+	bridge := &bridgeTUN{
+		Device:    netstack,
+		host:      host,
+		hostAddrs: hostAddrs,
+		packets:   make(chan []byte, 1024),
+		closed:    make(chan struct{}),
+		logger:    logger,
+	}
+
+	go bridge.pump(netstack)
+	go bridge.pump(host)
+
+	// events of the host device are not relevant to wireguard, but they must be drained
+	go func() {
+		for range host.Events() {
+		}
+	}()
+
+	return bridge
+}
+
+// pump reads packets from `dev` and queues them for wireguard
+func (b *bridgeTUN) pump(dev tun.Device) {
+	batch := dev.BatchSize()
+	bufs := make([][]byte, batch)
+	sizes := make([]int, batch)
+	for i := range bufs {
+		bufs[i] = make([]byte, device.MaxMessageSize)
+	}
+
+	for {
+		n, err := dev.Read(bufs, sizes, device.MessageTransportHeaderSize)
+		for i := 0; i < n; i++ {
+			packet := make([]byte, sizes[i])
+			copy(packet, bufs[i][device.MessageTransportHeaderSize:])
+			select {
+			case b.packets <- packet:
+			case <-b.closed:
+				return
+			}
+		}
+
+		if err != nil {
+			select {
+			case <-b.closed:
+				return
+			default:
+			}
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			b.logger.Errorf("Failed to read from TUN: %s", err.Error())
+		}
+	}
+}
+
+func (b *bridgeTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	var packet []byte
+	select {
+	case packet = <-b.packets:
+	case <-b.closed:
+		return 0, os.ErrClosed
+	}
+
+	n := 0
+	for {
+		sizes[n] = copy(bufs[n][offset:], packet)
+		n++
+		if n == len(bufs) {
+			return n, nil
+		}
+
+		select {
+		case packet = <-b.packets:
+		default:
+			return n, nil
+		}
+	}
+}
+
+// toHost checks if the destination address of an IP packet belongs to the host TUN
+func (b *bridgeTUN) toHost(packet []byte) bool {
+	var dst netip.Addr
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		dst = netip.AddrFrom4([4]byte(packet[16:20]))
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		dst = netip.AddrFrom16([16]byte(packet[24:40]))
+	default:
+		return false
+	}
+
+	for _, addr := range b.hostAddrs {
+		if addr == dst {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *bridgeTUN) Write(bufs [][]byte, offset int) (int, error) {
+	var toNetstack, toHost [][]byte
+	for _, buf := range bufs {
+		if b.toHost(buf[offset:]) {
+			toHost = append(toHost, buf)
+		} else {
+			toNetstack = append(toNetstack, buf)
+		}
+	}
+
+	if len(toNetstack) > 0 {
+		if _, err := b.Device.Write(toNetstack, offset); err != nil {
+			return 0, err
+		}
+	}
+	if len(toHost) > 0 {
+		if _, err := b.host.Write(toHost, offset); err != nil {
+			return len(toNetstack), err
+		}
+	}
+	return len(bufs), nil
+}
+
+func (b *bridgeTUN) BatchSize() int {
+	if size := b.host.BatchSize(); size > 1 {
+		return size
+	}
+	return 1
+}
+
+func (b *bridgeTUN) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		err = errors.Join(b.Device.Close(), b.host.Close())
+	})
+	return err
+}
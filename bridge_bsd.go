@@ -0,0 +1,14 @@
+//go:build darwin || freebsd || openbsd
+
+package wireproxy
+
+import (
+	"os"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// openTUNFromFD adopts a TUN device passed down by a parent process
+func openTUNFromFD(fd int, mtu int) (tun.Device, error) {
+	return tun.CreateTUNFromFile(os.NewFile(uintptr(fd), "/dev/tun"), mtu)
+}
@@ -0,0 +1,12 @@
+package wireproxy
+
+import (
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// openTUNFromFD adopts a TUN device created and configured by a privileged parent process.
+// The device is left unmonitored, as its MTU cannot be changed without privileges anyway.
+func openTUNFromFD(fd int, _ int) (tun.Device, error) {
+	dev, _, err := tun.CreateUnmonitoredTUNFromFD(fd)
+	return dev, err
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !openbsd
+
+package wireproxy
+
+import (
+	"errors"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// openTUNFromFD is not supported on this platform
+func openTUNFromFD(_ int, _ int) (tun.Device, error) {
+	return nil, errors.New("TUN from file descriptor is not supported on this platform")
+}
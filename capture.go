@@ -0,0 +1,380 @@
+package wireproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+const (
+	// pcapLinkTypeRaw is LINKTYPE_RAW, packets begin with an IPv4 or IPv6 header
+	pcapLinkTypeRaw = 101
+	pcapSnapLen     = 65535
+	// captureQueueSize is how many packets may be pending for a sink before packets are dropped
+	captureQueueSize = 1024
+)
+
+// CaptureFilter selects which packets are captured.
+// An empty list matches any host or port.
+type CaptureFilter struct {
+	Hosts []netip.Addr
+	Ports []uint16
+}
+
+// match checks whether an IP packet matches the filter
+func (f *CaptureFilter) match(packet []byte) bool {
+	if len(f.Hosts) == 0 && len(f.Ports) == 0 {
+		return true
+	}
+
+	var src, dst netip.Addr
+	var proto byte
+	var transport []byte
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		src = netip.AddrFrom4([4]byte(packet[12:16]))
+		dst = netip.AddrFrom4([4]byte(packet[16:20]))
+		proto = packet[9]
+		if ihl := int(packet[0]&0x0f) * 4; len(packet) >= ihl {
+			transport = packet[ihl:]
+		}
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		src = netip.AddrFrom16([16]byte(packet[8:24]))
+		dst = netip.AddrFrom16([16]byte(packet[24:40]))
+		proto = packet[6]
+		transport = packet[40:]
+	default:
+		return false
+	}
+
+	if len(f.Hosts) > 0 && !containsAddr(f.Hosts, src) && !containsAddr(f.Hosts, dst) {
+		return false
+	}
+
+	if len(f.Ports) > 0 {
+		// only TCP and UDP have ports
+		if (proto != 6 && proto != 17) || len(transport) < 4 {
+			return false
+		}
+		srcPort := binary.BigEndian.Uint16(transport[0:2])
+		dstPort := binary.BigEndian.Uint16(transport[2:4])
+		if !containsPort(f.Ports, srcPort) && !containsPort(f.Ports, dstPort) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsAddr(addrs []netip.Addr, addr netip.Addr) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ports []uint16, port uint16) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// pcapHeader returns the global header of a pcap file
+func pcapHeader() []byte {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:24], pcapLinkTypeRaw)
+	return header
+}
+
+// pcapRecord returns a pcap record containing `packet`
+func pcapRecord(t time.Time, packet []byte) []byte {
+	length := len(packet)
+	if length > pcapSnapLen {
+		length = pcapSnapLen
+	}
+
+	record := make([]byte, 16+length)
+	binary.LittleEndian.PutUint32(record[0:4], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(length))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(len(packet)))
+	copy(record[16:], packet[:length])
+	return record
+}
+
+// captureSink receives the pcap records of matching packets
+type captureSink struct {
+	filter  CaptureFilter
+	records chan []byte
+	done    chan struct{}
+}
+
+// PacketCapture dispatches the packets between netstack and wireguard to its sinks
+type PacketCapture struct {
+	lock  sync.RWMutex
+	sinks map[*captureSink]struct{}
+	// active mirrors len(sinks), so packets are not slowed down when nothing is captured
+	active atomic.Int32
+	logger *device.Logger
+}
+
+// NewPacketCapture creates a PacketCapture without any sink
+func NewPacketCapture(logger *device.Logger) *PacketCapture {
+	return &PacketCapture{sinks: make(map[*captureSink]struct{}), logger: logger}
+}
+
+// capture hands a copy of `packet` to every sink that wants it, dropping it for sinks that lag behind
+func (c *PacketCapture) capture(packet []byte) {
+	if c.active.Load() == 0 {
+		return
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var record []byte
+	for sink := range c.sinks {
+		if !sink.filter.match(packet) {
+			continue
+		}
+		if record == nil {
+			record = pcapRecord(time.Now(), packet)
+		}
+		select {
+		case sink.records <- record:
+		default:
+		}
+	}
+}
+
+// addSink starts writing matching packets to `w` until it fails or the sink is removed.
+// The pcap header is expected to be written by the caller.
+func (c *PacketCapture) addSink(filter CaptureFilter, w io.Writer) *captureSink {
+	sink := &captureSink{
+		filter:  filter,
+		records: make(chan []byte, captureQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	c.lock.Lock()
+	c.sinks[sink] = struct{}{}
+	c.active.Store(int32(len(c.sinks)))
+	c.lock.Unlock()
+
+	go func() {
+		defer close(sink.done)
+		if closer, ok := w.(io.Closer); ok {
+			defer closer.Close()
+		}
+		for record := range sink.records {
+			if _, err := w.Write(record); err != nil {
+				c.logger.Errorf("Failed to write packet capture: %s", err.Error())
+				c.removeSink(sink)
+				for range sink.records {
+				}
+				return
+			}
+		}
+	}()
+
+	return sink
+}
+
+// removeSink stops delivering packets to `sink`
+func (c *PacketCapture) removeSink(sink *captureSink) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.sinks[sink]; ok {
+		delete(c.sinks, sink)
+		c.active.Store(int32(len(c.sinks)))
+		close(sink.records)
+	}
+}
+
+// Close stops every sink and waits until they are done writing, which closes the capture file
+func (c *PacketCapture) Close() {
+	c.lock.RLock()
+	sinks := make([]*captureSink, 0, len(c.sinks))
+	for sink := range c.sinks {
+		sinks = append(sinks, sink)
+	}
+	c.lock.RUnlock()
+
+	for _, sink := range sinks {
+		c.removeSink(sink)
+		<-sink.done
+	}
+}
+
+// StartFile writes matching packets to a pcap file, which is rotated to `path`.1
+// when it would grow beyond maxSize bytes. A maxSize of 0 disables rotation.
+func (c *PacketCapture) StartFile(path string, filter CaptureFilter, maxSize int64) error {
+	file := &rotatingPcapFile{path: path, maxSize: maxSize}
+	if err := file.open(); err != nil {
+		return err
+	}
+	c.addSink(filter, file)
+	return nil
+}
+
+// rotatingPcapFile is a pcap file which starts over once it reaches its maximum size
+type rotatingPcapFile struct {
+	path    string
+	maxSize int64
+	size    int64
+	file    *os.File
+}
+
+func (f *rotatingPcapFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	header := pcapHeader()
+	if _, err := file.Write(header); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = int64(len(header))
+	return nil
+}
+
+func (f *rotatingPcapFile) Write(record []byte) (int, error) {
+	if f.maxSize > 0 && f.size+int64(len(record)) > f.maxSize {
+		_ = f.file.Close()
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return 0, err
+		}
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(record)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingPcapFile) Close() error {
+	return f.file.Close()
+}
+
+// flushWriter flushes every write to the HTTP client so packets show up immediately
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		f.flusher.Flush()
+	}
+	return n, err
+}
+
+// parseCaptureFilter parses comma separated hosts and ports into a CaptureFilter
+func parseCaptureFilter(hosts, ports string) (CaptureFilter, error) {
+	var filter CaptureFilter
+
+	for _, str := range strings.Split(hosts, ",") {
+		str = strings.TrimSpace(str)
+		if len(str) == 0 {
+			continue
+		}
+		addr, err := netip.ParseAddr(str)
+		if err != nil {
+			return filter, err
+		}
+		filter.Hosts = append(filter.Hosts, addr)
+	}
+
+	for _, str := range strings.Split(ports, ",") {
+		str = strings.TrimSpace(str)
+		if len(str) == 0 {
+			continue
+		}
+		port, err := strconv.ParseUint(str, 10, 16)
+		if err != nil {
+			return filter, fmt.Errorf("invalid port %s: %w", str, err)
+		}
+		filter.Ports = append(filter.Ports, uint16(port))
+	}
+
+	return filter, nil
+}
+
+// ServeHTTP streams matching packets as pcap until the client disconnects.
+// The filter is taken from the comma separated `host` and `port` query parameters.
+func (c *PacketCapture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseCaptureFilter(r.URL.Query().Get("host"), r.URL.Query().Get("port"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(pcapHeader()); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	sink := c.addSink(filter, flushWriter{w: w, flusher: flusher})
+	select {
+	case <-r.Context().Done():
+		c.removeSink(sink)
+		<-sink.done
+	case <-sink.done:
+	}
+}
+
+// captureTUN hands every packet going through the device to a PacketCapture
+type captureTUN struct {
+	tun.Device
+	capture *PacketCapture
+}
+
+func (t *captureTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := t.Device.Read(bufs, sizes, offset)
+	for i := 0; i < n; i++ {
+		t.capture.capture(bufs[i][offset : offset+sizes[i]])
+	}
+	return n, err
+}
+
+func (t *captureTUN) Write(bufs [][]byte, offset int) (int, error) {
+	for _, buf := range bufs {
+		t.capture.capture(buf[offset:])
+	}
+	return t.Device.Write(bufs, offset)
+}
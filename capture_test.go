@@ -0,0 +1,89 @@
+package wireproxy
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+func TestCaptureFilter(t *testing.T) {
+	client, server := netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1")
+	other := netip.MustParseAddr("10.0.0.3")
+	v6 := tcpPacket(netip.MustParseAddr("fd00::2"), netip.MustParseAddr("fd00::1"), 0x02, 1440)
+	icmp := tcpPacket(client, server, 0x02, 1460)
+	icmp[9] = 1
+
+	for _, test := range []struct {
+		name   string
+		filter CaptureFilter
+		packet []byte
+		want   bool
+	}{
+		{"empty filter", CaptureFilter{}, v6, true},
+		{"source host", CaptureFilter{Hosts: []netip.Addr{client}}, tcpPacket(client, server, 0x02, 1460), true},
+		{"destination host", CaptureFilter{Hosts: []netip.Addr{server}}, tcpPacket(client, server, 0x02, 1460), true},
+		{"other host", CaptureFilter{Hosts: []netip.Addr{other}}, tcpPacket(client, server, 0x02, 1460), false},
+		{"IPv6 host", CaptureFilter{Hosts: []netip.Addr{netip.MustParseAddr("fd00::1")}}, v6, true},
+		{"source port", CaptureFilter{Ports: []uint16{40000}}, v6, true},
+		{"destination port", CaptureFilter{Ports: []uint16{443}}, v6, true},
+		{"other port", CaptureFilter{Ports: []uint16{80}}, v6, false},
+		{"host and other port", CaptureFilter{Hosts: []netip.Addr{client}, Ports: []uint16{80}}, tcpPacket(client, server, 0x02, 1460), false},
+		{"port without transport", CaptureFilter{Ports: []uint16{443}}, icmp, false},
+		{"truncated", CaptureFilter{Hosts: []netip.Addr{client}}, make([]byte, 10), false},
+	} {
+		if got := test.filter.match(test.packet); got != test.want {
+			t.Errorf("%s: match = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+// pcapRecords returns how many records the pcap file at `path` holds
+func pcapRecords(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 24 || binary.LittleEndian.Uint32(data) != 0xa1b2c3d4 {
+		t.Fatalf("%s has no pcap header", path)
+	}
+
+	records := 0
+	for data = data[24:]; len(data) > 0; records++ {
+		if len(data) < 16 {
+			t.Fatalf("%s ends with a truncated record", path)
+		}
+		data = data[16+binary.LittleEndian.Uint32(data[8:12]):]
+	}
+	return records
+}
+
+func TestCaptureFileRotation(t *testing.T) {
+	client, server := netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1")
+	packet := tcpPacket(client, server, 0x02, 1460)
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+
+	// room for the header and two records
+	capture := NewPacketCapture(device.NewLogger(device.LogLevelSilent, ""))
+	maxSize := int64(24 + 2*(16+len(packet)))
+	if err := capture.StartFile(path, CaptureFilter{Hosts: []netip.Addr{server}}, maxSize); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		capture.capture(packet)
+	}
+	// filtered out
+	capture.capture(tcpPacket(client, netip.MustParseAddr("10.0.0.3"), 0x02, 1460))
+	capture.Close()
+
+	if records := pcapRecords(t, path+".1"); records != 2 {
+		t.Errorf("expected 2 packets in the rotated file, got %d", records)
+	}
+	if records := pcapRecords(t, path); records != 1 {
+		t.Errorf("expected 1 packet in the current file, got %d", records)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+)
+
+// writePidfile writes the pid of the process to `path`, unless the instance which wrote it is still running
+func writePidfile(path string) error {
+	if pid, err := readPidfile(path); err == nil && pid != os.Getpid() && processAlive(pid) {
+		return fmt.Errorf("wireproxy is already running with pid %d", pid)
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+func readPidfile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, errors.New(path + " does not contain a pid")
+	}
+	return pid, nil
+}
+
+// removePidfile removes the pidfile on exit, unless another instance took it over
+func removePidfile(path string) {
+	if pid, err := readPidfile(path); err == nil && pid == os.Getpid() {
+		_ = os.Remove(path)
+	}
+}
+
+// stop terminates the instance whose pid is in a pidfile, and waits for it to exit
+func stop(args []string) error {
+	parser := argparse.NewParser("wireproxy stop", "Stop an instance started with --pidfile")
+	pidfile := parser.String("p", "pidfile", &argparse.Options{Help: "Path of the pidfile of the instance", Required: true})
+	timeout := parser.Int("t", "timeout", &argparse.Options{Help: "Seconds to wait for the instance to exit", Default: 10})
+	if err := parser.Parse(append([]string{"wireproxy stop"}, args...)); err != nil {
+		fmt.Print(parser.Usage(err))
+		return errors.New("invalid arguments")
+	}
+	pledgeOrPanic("stdio rpath cpath proc")
+
+	pid, err := readPidfile(*pidfile)
+	if err != nil {
+		return err
+	}
+	if !processAlive(pid) {
+		return fmt.Errorf("no instance is running with pid %d", pid)
+	}
+	if err := terminateProcess(pid); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(time.Duration(*timeout) * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("pid %d did not exit after %d seconds", pid, *timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// an instance which was killed rather than terminated, as on Windows, leaves its pidfile behind
+	if p, err := readPidfile(*pidfile); err == nil && p == pid {
+		return os.Remove(*pidfile)
+	}
+	return nil
+}
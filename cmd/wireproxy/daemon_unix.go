@@ -0,0 +1,53 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// detachAttr starts the daemon process in a new session, without a controlling terminal
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// redirectOutput appends everything written to stderr, including panics, to `path`.
+// Standard output is left alone, it is only used by STDIO tunnels.
+func redirectOutput(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return unix.Dup2(int(file.Fd()), syscall.Stderr)
+}
+
+// reopenLogOnSignal reopens the log file on SIGUSR1, after it was moved away by logrotate
+func reopenLogOnSignal(path string, logger *device.Logger) {
+	s := make(chan os.Signal, 1)
+	signal.Notify(s, syscall.SIGUSR1)
+	go func() {
+		for range s {
+			if err := redirectOutput(path); err != nil {
+				logger.Errorf("Failed to reopen %s: %s", path, err.Error())
+				continue
+			}
+			logger.Verbosef("Reopened %s", path)
+		}
+	}()
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func terminateProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
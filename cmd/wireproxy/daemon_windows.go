@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// detachAttr starts the daemon process without a console
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: windows.CREATE_NEW_PROCESS_GROUP | windows.DETACHED_PROCESS}
+}
+
+// redirectOutput appends everything logged to `path`
+func redirectOutput(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	os.Stderr = file
+	log.SetOutput(file)
+	return nil
+}
+
+// reopenLogOnSignal does nothing as there is no SIGUSR1 on Windows
+func reopenLogOnSignal(string, *device.Logger) {}
+
+func processAlive(pid int) bool {
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION|windows.SYNCHRONIZE, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(process)
+	event, err := windows.WaitForSingleObject(process, 0)
+	return err == nil && event == uint32(windows.WAIT_TIMEOUT)
+}
+
+// terminateProcess kills the process, Windows having no signal to ask it to exit,
+// so the instance doesn't get to remove its pidfile and stop does it instead
+func terminateProcess(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Kill()
+}
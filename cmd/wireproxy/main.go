@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/landlock-lsm/go-landlock/landlock"
+	ll "github.com/landlock-lsm/go-landlock/landlock/syscall"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/akamensky/argparse"
@@ -67,32 +73,88 @@ func configFilePath() (string, bool) {
     return "", false
 }
 
-func lock(stage string) {
+// lock restricts the process further at each stage, `needs` tells what the configuration
+// needs while it is read, `conf` and `writable` which directories are written to afterwards
+func lock(stage string, needs *wireproxy.ConfigNeeds, conf *wireproxy.Configuration, writable ...string) {
 	switch stage {
 	case "boot":
 		exePath := executablePath()
 		// OpenBSD
 		unveilOrPanic("/", "r")
 		unveilOrPanic(exePath, "x")
+		if needs.Exec {
+			unveilOrPanic("/bin/sh", "x")
+		}
 		// only allow standard stdio operation, file reading, networking, and exec
-		// also remove unveil permission to lock unveil
-		pledgeOrPanic("stdio rpath inet dns proc exec")
+		// also remove unveil permission to lock unveil, unless directories are made writable later
+		promises := "stdio rpath inet dns proc exec" + writePromises(needs)
+		if needs.Write {
+			promises += " unveil"
+		}
+		pledgeOrPanic(promises)
 		// Linux
-		panicIfError(landlock.V1.BestEffort().RestrictPaths(
-			landlock.RODirs("/"),
-		))
+		// landlock rulesets can only be tightened, so with writable directories file
+		// access is restricted once the configuration tells which ones
+		if !needs.Write {
+			panicIfError(landlock.V1.BestEffort().RestrictPaths(landlock.RODirs("/")))
+		}
 	case "boot-daemon":
 	case "read-config":
 		// OpenBSD
-		pledgeOrPanic("stdio rpath inet dns")
+		promises := "stdio rpath inet dns" + writePromises(needs)
+		if needs.Write {
+			promises += " unveil"
+		}
+		// exec: references in the configuration run commands with the shell
+		if needs.Exec {
+			promises += " proc exec"
+		}
+		pledgeOrPanic(promises)
+	case "writable":
+		// only the directories required by the configuration can be written to from now on
+		writableDirs := append(writableDirs(conf), writable...)
+		// OpenBSD
+		for _, dir := range writableDirs {
+			unveilOrPanic(dir, "rwc")
+		}
+		for _, device := range tunDevices(conf) {
+			unveilOrPanic(device, "rw")
+		}
+		promises := "stdio rpath inet dns"
+		if len(writableDirs) > 0 {
+			promises += " wpath cpath"
+		} else if len(tunDevices(conf)) > 0 {
+			promises += " wpath"
+		}
+		if len(unixSockets(conf)) > 0 {
+			promises += " unix chown"
+		}
+		pledgeOrPanic(promises)
+		// Linux
+		if needs.Write {
+			rules := append(deviceRules(conf), landlock.RODirs("/"), landlock.RWDirs(writableDirs...))
+			panicIfError(landlock.V1.BestEffort().RestrictPaths(rules...))
+		}
 	case "ready":
 		// no file access is allowed from now on, only networking
+		// and writing to directories required by the configuration
+		writableDirs := append(writableDirs(conf), writable...)
 		// OpenBSD
-		pledgeOrPanic("stdio inet dns")
+		promises := "stdio inet dns"
+		if len(writableDirs) > 0 {
+			promises = "stdio rpath wpath cpath inet dns"
+		} else if len(tunDevices(conf)) > 0 {
+			promises = "stdio rpath wpath inet dns"
+		}
+		if len(unixSockets(conf)) > 0 {
+			promises += " unix chown"
+		}
+		pledgeOrPanic(promises)
 		// Linux
 		net.DefaultResolver.PreferGo = true // needed to lock down dependencies
-		panicIfError(landlock.V1.BestEffort().RestrictPaths(
+		rules := []landlock.Rule{
 			landlock.ROFiles("/etc/resolv.conf").IgnoreIfMissing(),
+			landlock.ROFiles("/etc/hosts").IgnoreIfMissing(),
 			landlock.ROFiles("/dev/fd").IgnoreIfMissing(),
 			landlock.ROFiles("/dev/zero").IgnoreIfMissing(),
 			landlock.ROFiles("/dev/urandom").IgnoreIfMissing(),
@@ -110,7 +172,12 @@ func lock(stage string) {
 			landlock.RWFiles("/dev/null").IgnoreIfMissing(),
 			landlock.RWFiles("/dev/full").IgnoreIfMissing(),
 			landlock.RWFiles("/proc/self/fd").IgnoreIfMissing(),
-		))
+		}
+		if len(writableDirs) > 0 {
+			rules = append(rules, landlock.RWDirs(writableDirs...))
+		}
+		rules = append(rules, deviceRules(conf)...)
+		panicIfError(landlock.V1.BestEffort().RestrictPaths(rules...))
 	default:
 		panic("invalid stage")
 	}
@@ -130,8 +197,91 @@ func extractPort(addr string) uint16 {
 	return uint16(port)
 }
 
-func lockNetwork(sections []wireproxy.RoutineSpawner, infoAddr *string) {
+// writePromises returns the pledge promises needed to create the files and unix sockets
+// of a configuration with `needs`
+func writePromises(needs *wireproxy.ConfigNeeds) string {
+	var promises string
+	if needs.Write {
+		promises += " wpath cpath"
+	}
+	if needs.UnixSockets {
+		promises += " unix chown"
+	}
+	return promises
+}
+
+// deviceRules returns the devices the configuration opens after the ready stage
+func deviceRules(conf *wireproxy.Configuration) []landlock.Rule {
 	var rules []landlock.Rule
+	if conf.Device.TUN != nil && conf.Device.TUN.FD == nil {
+		// needed to create a host TUN device for [TUN]
+		rules = append(rules, landlock.RWFiles("/dev/net/tun").IgnoreIfMissing())
+	}
+	return rules
+}
+
+// tunDevices returns the device files the host TUN device of [TUN] may be opened from on OpenBSD,
+// /dev/tunN for the name tunN, or any of them as wireguard-go tries them in turn otherwise
+func tunDevices(conf *wireproxy.Configuration) []string {
+	if conf.Device.TUN == nil || conf.Device.TUN.FD != nil {
+		return nil
+	}
+	var index int
+	if _, err := fmt.Sscanf(conf.Device.TUN.Name, "tun%d", &index); err == nil {
+		return []string{fmt.Sprintf("/dev/tun%d", index)}
+	}
+	devices := make([]string, 0, 256)
+	for index := 0; index < 256; index++ {
+		devices = append(devices, fmt.Sprintf("/dev/tun%d", index))
+	}
+	return devices
+}
+
+// writableDirs returns the directories the configuration needs to write to after the ready stage
+func writableDirs(conf *wireproxy.Configuration) []string {
+	var dirs []string
+	if conf.Device.Capture != nil && conf.Device.Capture.File != "" {
+		dirs = append(dirs, filepath.Dir(conf.Device.Capture.File))
+	}
+	if conf.Device.Accounting != nil {
+		dirs = append(dirs, filepath.Dir(conf.Device.Accounting.StateFile))
+	}
+	for _, socket := range unixSockets(conf) {
+		dirs = append(dirs, filepath.Dir(socket))
+	}
+	return dirs
+}
+
+// unixSockets returns the paths of the unix sockets the configuration listens on
+func unixSockets(conf *wireproxy.Configuration) []string {
+	var sockets []string
+	if conf.Device.UAPI != nil {
+		sockets = append(sockets, conf.Device.UAPI.Socket)
+	}
+	for _, routine := range conf.Routines {
+		switch routine := routine.(type) {
+		case *wireproxy.TCPClientTunnelConfig:
+			if routine.UnixSocket != "" {
+				sockets = append(sockets, routine.UnixSocket)
+			}
+		case *wireproxy.Socks5Config:
+			if path, ok := strings.CutPrefix(routine.BindAddress, "unix:"); ok {
+				sockets = append(sockets, path)
+			}
+		case *wireproxy.HTTPConfig:
+			if path, ok := strings.CutPrefix(routine.BindAddress, "unix:"); ok {
+				sockets = append(sockets, path)
+			}
+		}
+	}
+	return sockets
+}
+
+func lockNetwork(sections []wireproxy.RoutineSpawner, infoAddr *string) {
+	var rules, connects []landlock.Rule
+	// reverse proxies without AllowedPorts may connect to any port, which drops the
+	// connect restrictions of the whole process, see AllowedPorts in the README
+	connectAnyPort := false
 	if infoAddr != nil && *infoAddr != "" {
 		rules = append(rules, landlock.BindTCP(extractPort(*infoAddr)))
 	}
@@ -139,22 +289,102 @@ func lockNetwork(sections []wireproxy.RoutineSpawner, infoAddr *string) {
 	for _, section := range sections {
 		switch section := section.(type) {
 		case *wireproxy.TCPServerTunnelConfig:
-			rules = append(rules, landlock.ConnectTCP(extractPort(section.Target)))
+			if section.Target != "" {
+				connects = append(connects, landlock.ConnectTCP(extractPort(section.Target)))
+			}
+			for _, target := range section.Targets {
+				connects = append(connects, landlock.ConnectTCP(extractPort(target)))
+			}
+		// sockets passed by systemd are already bound, and unix sockets are
+		// covered by the writable directories of the ready stage
 		case *wireproxy.HTTPConfig:
-			rules = append(rules, landlock.BindTCP(extractPort(section.BindAddress)))
+			if section.SystemdSocket == "" && !strings.HasPrefix(section.BindAddress, "unix:") {
+				rules = append(rules, landlock.BindTCP(extractPort(section.BindAddress)))
+			}
 		case *wireproxy.TCPClientTunnelConfig:
-			rules = append(rules, landlock.ConnectTCP(uint16(section.BindAddress.Port)))
+			if section.BindAddress != nil {
+				rules = append(rules, landlock.ConnectTCP(uint16(section.BindAddress.Port)))
+			}
 		case *wireproxy.Socks5Config:
+			if section.SystemdSocket == "" && !strings.HasPrefix(section.BindAddress, "unix:") {
+				rules = append(rules, landlock.BindTCP(extractPort(section.BindAddress)))
+			}
+		case *wireproxy.Socks5ServerConfig:
+			connectAnyPort = connectAnyPort || len(section.AllowedPorts) == 0
+			for _, port := range section.AllowedPorts {
+				connects = append(connects, landlock.ConnectTCP(port))
+			}
+		case *wireproxy.HTTPServerConfig:
+			connectAnyPort = connectAnyPort || len(section.AllowedPorts) == 0
+			for _, port := range section.AllowedPorts {
+				connects = append(connects, landlock.ConnectTCP(port))
+			}
+		case *wireproxy.TransparentProxyConfig:
 			rules = append(rules, landlock.BindTCP(extractPort(section.BindAddress)))
 		}
 	}
 
-	panicIfError(landlock.V4.BestEffort().RestrictNet(rules...))
+	if connectAnyPort {
+		config := landlock.MustConfig(landlock.AccessNetSet(ll.AccessNetBindTCP))
+		panicIfError(config.BestEffort().RestrictNet(rules...))
+		return
+	}
+	panicIfError(landlock.V4.BestEffort().RestrictNet(append(rules, connects...)...))
+}
+
+// forwardStdio connects standard input and output to `target` until either side closes the
+// connection, and returns the exit status of the process
+func forwardStdio(ctx context.Context, instance *wireproxy.Instance, target string) int {
+	done := make(chan error, 1)
+	go func() {
+		tunnel := &wireproxy.STDIOTunnelConfig{Target: target}
+		done <- tunnel.SpawnRoutine(ctx, instance.VirtualTun())
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+	}
+	if closeErr := instance.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+// reportConfigTest prints the problems found in a configuration, and exits with
+// a failure status if there are any
+func reportConfigTest(problems []*wireproxy.ConfigError, asJSON bool) {
+	if asJSON {
+		if problems == nil {
+			problems = []*wireproxy.ConfigError{}
+		}
+		output, err := json.MarshalIndent(map[string]interface{}{
+			"ok":       len(problems) == 0,
+			"problems": problems,
+		}, "", "  ")
+		panicIfError(err)
+		fmt.Println(string(output))
+	} else if len(problems) == 0 {
+		fmt.Println("Config OK")
+	} else {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
 }
 
 func main() {
 	s := make(chan os.Signal, 1)
-	signal.Notify(s, syscall.SIGINT, syscall.SIGQUIT)
+	signal.Notify(s, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 	ctx, cancel := context.WithCancel(context.Background())
 
 	go func() {
@@ -162,24 +392,33 @@ func main() {
 		cancel()
 	}()
 
+	if runSubcommand(os.Args) {
+		return
+	}
+
 	exePath := executablePath()
-	lock("boot")
 
 	isDaemonProcess := len(os.Args) > 1 && os.Args[1] == daemonProcess
 	args := os.Args
 	if isDaemonProcess {
-		lock("boot-daemon")
 		args = []string{args[0]}
 		args = append(args, os.Args[2:]...)
 	}
 	parser := argparse.NewParser("wireproxy", "Userspace wireguard client for proxying")
 
-	config := parser.String("c", "config", &argparse.Options{Help: "Path of configuration file"})
+	config := parser.String("c", "config", &argparse.Options{Help: "Path of configuration file, - to read it from standard input"})
+	format := parser.Selector("f", "format", []string{wireproxy.FormatINI, wireproxy.FormatJSON, wireproxy.FormatYAML, wireproxy.FormatTOML}, &argparse.Options{Help: "Format of the configuration, detected from the extension of the file by default, and ini for standard input"})
 	silent := parser.Flag("s", "silent", &argparse.Options{Help: "Silent mode"})
 	daemon := parser.Flag("d", "daemon", &argparse.Options{Help: "Make wireproxy run in background"})
 	info := parser.String("i", "info", &argparse.Options{Help: "Specify the address and port for exposing health status"})
 	printVerison := parser.Flag("v", "version", &argparse.Options{Help: "Print version"})
 	configTest := parser.Flag("n", "configtest", &argparse.Options{Help: "Configtest mode. Only check the configuration file for validity."})
+	configTestJSON := parser.Flag("", "json", &argparse.Options{Help: "Report the problems found in configtest mode as JSON"})
+	dumpConfig := parser.Selector("", "dump-config", []string{wireproxy.FormatINI, wireproxy.FormatJSON}, &argparse.Options{Help: "Print the effective configuration with secrets redacted, and exit"})
+	pidfile := parser.String("", "pidfile", &argparse.Options{Help: "Write the pid of the process to this file, for wireproxy stop"})
+	logFile := parser.String("", "log-file", &argparse.Options{Help: "Append logs to this file instead of standard error, it is reopened on SIGUSR1"})
+	stdio := parser.String("", "stdio", &argparse.Options{Help: "Connect standard input and output to this host:port through wireguard, e.g. as an ssh ProxyCommand, instead of starting the routines of the configuration"})
+	waitHandshake := parser.Flag("", "wait-handshake", &argparse.Options{Help: "With systemd Type=notify, only report readiness once a peer completed a handshake"})
 
 	err := parser.Parse(args)
 	if err != nil {
@@ -201,31 +440,100 @@ func main() {
         }
 	}
 
-	if !*daemon {
-		lock("read-config")
+	if *config == "-" && *daemon {
+		fmt.Println("reading the configuration from standard input is not supported in daemon mode")
+		return
+	}
+
+	if *stdio != "" {
+		if _, _, err := net.SplitHostPort(*stdio); err != nil {
+			fmt.Fprintln(os.Stderr, "--stdio expects host:port: "+err.Error())
+			os.Exit(1)
+		}
+		if *daemon || *config == "-" {
+			fmt.Fprintln(os.Stderr, "--stdio can't be used with -d or -c -, which take over standard input")
+			os.Exit(1)
+		}
 	}
 
-	conf, err := wireproxy.ParseConfig(*config)
+	// the configuration is read once so that the sandbox is fitted to it
+	var data []byte
+	configPath, configFormat := *config, *format
+	if *config == "-" {
+		configPath = ""
+		data, err = io.ReadAll(os.Stdin)
+		if configFormat == "" {
+			configFormat = wireproxy.FormatINI
+		}
+	} else {
+		data, err = os.ReadFile(*config)
+		if configFormat == "" {
+			configFormat = wireproxy.FormatFromPath(*config)
+		}
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	needs, err := wireproxy.ScanConfig(configPath, data, configFormat)
+	if err != nil {
+		// parsing reports the error below
+		needs = &wireproxy.ConfigNeeds{}
+	}
+	needs.Write = needs.Write || *logFile != "" || *pidfile != ""
+	// a configuration test doesn't run exec: references
+	needs.Exec = needs.Exec && !*configTest
+
+	lock("boot", needs, nil)
+	if isDaemonProcess {
+		lock("boot-daemon", needs, nil)
+	}
+	if !*daemon {
+		lock("read-config", needs, nil)
+	}
 
 	if *configTest {
-		fmt.Println("Config OK")
+		var problems []*wireproxy.ConfigError
+		if *config == "-" {
+			problems = wireproxy.CheckConfigFormat(bytes.NewReader(data), configFormat)
+		} else {
+			problems = wireproxy.CheckConfigFile(*config, configFormat)
+		}
+		reportConfigTest(problems, *configTestJSON)
 		return
 	}
 
+	var conf *wireproxy.Configuration
+	if *config == "-" {
+		conf, err = wireproxy.ParseConfigFormat(bytes.NewReader(data), configFormat, wireproxy.WithCommands())
+	} else {
+		conf, err = wireproxy.ParseConfigFile(*config, configFormat, wireproxy.WithCommands())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *dumpConfig != "" {
+		output, err := wireproxy.DumpConfig(conf, *dumpConfig)
+		panicIfError(err)
+		fmt.Print(string(output))
+		return
+	}
+
+	if *stdio != "" {
+		conf.Routines = nil
+	}
+
 	lockNetwork(conf.Routines, info)
 
 	if isDaemonProcess {
-		os.Stdout, _ = os.Open(os.DevNull)
-		os.Stderr, _ = os.Open(os.DevNull)
+		// standard input and output are /dev/null, as left by exec.Cmd
 		*daemon = false
 	}
 
 	if *daemon {
 		args[0] = daemonProcess
 		cmd := exec.Command(exePath, args...)
+		cmd.SysProcAttr = detachAttr()
 		err = cmd.Start()
 		if err != nil {
 			fmt.Println(err.Error())
@@ -233,36 +541,80 @@ func main() {
 		return
 	}
 
+	var writable []string
+	if *logFile != "" {
+		writable = append(writable, filepath.Dir(*logFile))
+	}
+	if *pidfile != "" {
+		writable = append(writable, filepath.Dir(*pidfile))
+	}
+	lock("writable", needs, conf, writable...)
+
+	if *logFile != "" {
+		if err := redirectOutput(*logFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *pidfile != "" {
+		if err := writePidfile(*pidfile); err != nil {
+			log.Fatal(err)
+		}
+		defer removePidfile(*pidfile)
+	}
+
 	// Wireguard doesn't allow configuring which FD to use for logging
 	// https://github.com/WireGuard/wireguard-go/blob/master/device/logger.go#L39
 	// so redirect STDOUT to STDERR, we don't want to print anything to STDOUT anyways
-	os.Stdout = os.NewFile(uintptr(syscall.Stderr), "/dev/stderr")
+	os.Stdout = os.Stderr
 	logLevel := device.LogLevelVerbose
+	if *stdio != "" {
+		// the logs end up in the output of ssh
+		logLevel = device.LogLevelError
+	}
+	logger := device.NewLogger(logLevel, "")
+	// silent mode only silences wireguard, the messages of wireproxy are still logged
+	deviceLogger := logger
 	if *silent {
-		logLevel = device.LogLevelSilent
+		deviceLogger = device.NewLogger(device.LogLevelSilent, "")
 	}
 
-	lock("ready")
-
-	tun, err := wireproxy.StartWireguard(conf.Device, logLevel)
+	instance, err := wireproxy.New(conf, wireproxy.WithLogger(logger), wireproxy.WithDeviceLogger(deviceLogger))
 	if err != nil {
 		log.Fatal(err)
 	}
+	notifier := newNotifier()
 
-	for _, spawner := range conf.Routines {
-		go spawner.SpawnRoutine(tun)
+	if *logFile != "" {
+		reopenLogOnSignal(*logFile, logger)
 	}
+	lock("ready", needs, conf, writable...)
 
-	tun.StartPingIPs()
+	err = instance.Start(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if *info != "" {
 		go func() {
-			err := http.ListenAndServe(*info, tun)
+			err := http.ListenAndServe(*info, instance.VirtualTun())
 			if err != nil {
 				panic(err)
 			}
 		}()
 	}
+	go notifier.run(ctx, instance, *waitHandshake)
+
+	if *stdio != "" {
+		status := forwardStdio(ctx, instance, *stdio)
+		if *pidfile != "" {
+			removePidfile(*pidfile)
+		}
+		os.Exit(status)
+	}
 
 	<-ctx.Done()
+	notifier.notify("STOPPING=1\n")
+	if err := instance.Close(); err != nil {
+		log.Println(err)
+	}
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/pufferffish/wireproxy"
+)
+
+// statusTimeout bounds how long fetching the status of a running instance may take
+const statusTimeout = 10 * time.Second
+
+// status prints the status of a running instance, fetched from its health endpoint
+func status(args []string) error {
+	parser := argparse.NewParser("wireproxy status", "Show the peers and routines of a running instance")
+	info := parser.String("i", "info", &argparse.Options{Help: "Address and port of the health endpoint of the instance", Required: true})
+	asJSON := parser.Flag("", "json", &argparse.Options{Help: "Print the status as JSON"})
+	if err := parser.Parse(append([]string{"wireproxy status"}, args...)); err != nil {
+		fmt.Print(parser.Usage(err))
+		return errors.New("invalid arguments")
+	}
+
+	client := http.Client{Timeout: statusTimeout}
+	resp, err := client.Get("http://" + *info + "/status")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("health endpoint responded with " + resp.Status)
+	}
+
+	if *asJSON {
+		_, err := os.Stdout.Write(body)
+		return err
+	}
+
+	var s wireproxy.Status
+	if err := json.Unmarshal(body, &s); err != nil {
+		return err
+	}
+	printStatus(os.Stdout, &s)
+	return nil
+}
+
+// printStatus prints tables of the peers and routines of an instance
+func printStatus(out io.Writer, s *wireproxy.Status) {
+	fmt.Fprintf(out, "public key: %s\n", s.PublicKey)
+	if s.ListenPort != 0 {
+		fmt.Fprintf(out, "listening port: %d\n", s.ListenPort)
+	}
+	fmt.Fprintln(out)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tENDPOINT\tLATEST HANDSHAKE\tRECEIVED\tSENT\tALLOWED IPS")
+	for _, peer := range s.Peers {
+		endpoint := peer.Endpoint
+		if endpoint == "" {
+			endpoint = "-"
+		}
+		handshake := "never"
+		if peer.LatestHandshake != nil {
+			handshake = formatAge(time.Since(*peer.LatestHandshake)) + " ago"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", peer.PublicKey, endpoint, handshake,
+			formatBytes(peer.ReceivedBytes), formatBytes(peer.SentBytes), strings.Join(peer.AllowedIPs, ", "))
+	}
+	_ = w.Flush()
+
+	if len(s.Routines) == 0 {
+		return
+	}
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROUTINE\tSTATE\tCONNECTIONS\tACCEPTED\tRESTARTS\tERROR")
+	for _, routine := range s.Routines {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n", routine.Name, routine.State,
+			routine.Connections, routine.Accepted, routine.Restarts, routine.Error)
+	}
+	_ = w.Flush()
+}
+
+// formatAge formats a duration like wg show, e.g. "1 minute, 3 seconds"
+func formatAge(d time.Duration) string {
+	if d < time.Second {
+		return "now"
+	}
+
+	var parts []string
+	for _, unit := range []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+		{"second", time.Second},
+	} {
+		n := d / unit.duration
+		if n == 0 {
+			continue
+		}
+		d -= n * unit.duration
+		part := fmt.Sprintf("%d %s", n, unit.name)
+		if n > 1 {
+			part += "s"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatBytes formats a number of bytes with binary units, e.g. "1.50 MiB"
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < 4 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.2f %s", value, []string{"B", "KiB", "MiB", "GiB", "TiB"}[unit])
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/akamensky/argparse"
+	"github.com/pufferffish/wireproxy"
+)
+
+// subcommands are run by `wireproxy <name> [arguments]` instead of starting the proxy
+var subcommands = map[string]func(args []string) error{
+	"genkey": genkey,
+	"pubkey": pubkey,
+	"genpsk": genpsk,
+	"init":   initConfig,
+	"status": status,
+	"stop":   stop,
+}
+
+// runSubcommand runs the subcommand named by the first argument, if any,
+// and reports whether there was one
+func runSubcommand(args []string) bool {
+	if len(args) < 2 {
+		return false
+	}
+	run, ok := subcommands[args[1]]
+	if !ok {
+		return false
+	}
+
+	if err := run(args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "wireproxy %s: %s\n", args[1], err.Error())
+		os.Exit(1)
+	}
+	return true
+}
+
+// genkey prints a new private key
+func genkey([]string) error {
+	pledgeOrPanic("stdio")
+	key, err := wireproxy.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// pubkey reads a private key from standard input and prints its public key
+func pubkey([]string) error {
+	pledgeOrPanic("stdio")
+	privateKey, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	key, err := wireproxy.PublicKey(string(privateKey))
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// genpsk prints a new preshared key
+func genpsk([]string) error {
+	pledgeOrPanic("stdio")
+	key, err := wireproxy.GeneratePresharedKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+const configTemplate = `[Interface]
+Address = %s
+PrivateKey = %s
+%s
+
+[Peer]
+%s
+%s
+AllowedIPs = %s
+
+[Socks5]
+BindAddress = %s
+`
+
+// initConfig writes a skeleton configuration with a new private key, asking for the
+// values which are not given as arguments, and prints the public key to give to the peer
+func initConfig(args []string) error {
+	parser := argparse.NewParser("wireproxy init", "Write a configuration with a new private key")
+	output := parser.String("o", "output", &argparse.Options{Help: "Path of the configuration file to write", Default: default_config_paths[1]})
+	force := parser.Flag("f", "force", &argparse.Options{Help: "Overwrite an existing configuration file"})
+	address := parser.String("", "address", &argparse.Options{Help: "Address of this peer in the wireguard network"})
+	dns := parser.String("", "dns", &argparse.Options{Help: "DNS servers to resolve hostnames with"})
+	peerPublicKey := parser.String("", "peer-public-key", &argparse.Options{Help: "Public key of the server"})
+	endpoint := parser.String("", "endpoint", &argparse.Options{Help: "Address and port of the server"})
+	allowedIPs := parser.String("", "allowed-ips", &argparse.Options{Help: "Addresses routed to the server", Default: "0.0.0.0/0, ::/0"})
+	socks5 := parser.String("", "socks5", &argparse.Options{Help: "Address and port to run a SOCKS5 proxy on", Default: "127.0.0.1:25344"})
+	if err := parser.Parse(append([]string{"wireproxy init"}, args...)); err != nil {
+		fmt.Print(parser.Usage(err))
+		return errors.New("invalid arguments")
+	}
+
+	pledgeOrPanic("stdio rpath wpath cpath")
+	if _, err := os.Stat(*output); err == nil && !*force {
+		return errors.New(*output + " already exists, use --force to overwrite it")
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	ask := func(value *string, question, fallback string) error {
+		if *value != "" {
+			return nil
+		}
+		if fallback != "" {
+			question += " [" + fallback + "]"
+		}
+		fmt.Fprint(os.Stderr, question+": ")
+		answer, err := stdin.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		*value = strings.TrimSpace(answer)
+		if *value == "" {
+			*value = fallback
+		}
+		return nil
+	}
+	for _, question := range []struct {
+		value    *string
+		question string
+		fallback string
+	}{
+		{address, "Address of this peer", "10.0.0.2/32"},
+		{dns, "DNS servers (optional)", ""},
+		{peerPublicKey, "Public key of the server (optional)", ""},
+		{endpoint, "Endpoint of the server (optional)", ""},
+	} {
+		if err := ask(question.value, question.question, question.fallback); err != nil {
+			return err
+		}
+	}
+
+	privateKey, err := wireproxy.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	publicKey, err := wireproxy.PublicKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	// values which are still missing are left for the user to fill in
+	optional := func(key, value, placeholder string) string {
+		if value == "" {
+			return "# " + key + " = " + placeholder
+		}
+		return key + " = " + value
+	}
+	config := fmt.Sprintf(configTemplate,
+		*address, privateKey, optional("DNS", *dns, "10.0.0.1"),
+		optional("PublicKey", *peerPublicKey, "<public key of the server>"),
+		optional("Endpoint", *endpoint, "<host:port of the server>"),
+		*allowedIPs, *socks5,
+	)
+
+	if err := os.MkdirAll(filepath.Dir(*output), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*output, []byte(config), 0600); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Wrote %s, give this public key to the administrator of the server:\n", *output)
+	fmt.Println(publicKey)
+	return nil
+}
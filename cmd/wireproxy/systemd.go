@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pufferffish/wireproxy"
+)
+
+// statusInterval is how often the status is reported to systemd without a watchdog
+const statusInterval = 30 * time.Second
+
+// handshakeTimeout is how recent the latest handshake of a peer must be for it to count
+// as connected, after which wireguard rejects the session keys
+const handshakeTimeout = 180 * time.Second
+
+// notifier reports the state of the process to systemd, for units with Type=notify
+type notifier struct {
+	conn     net.Conn
+	watchdog time.Duration
+}
+
+// newNotifier connects to the socket in $NOTIFY_SOCKET, it must be called before the
+// process is sandboxed. It returns nil when not started by systemd with Type=notify.
+func newNotifier() *notifier {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// abstract sockets are written with a leading @
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect to the systemd notification socket: %s\n", err.Error())
+		return nil
+	}
+
+	n := &notifier{conn: conn}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid := os.Getenv("WATCHDOG_PID")
+	if err == nil && usec > 0 && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	_ = os.Unsetenv("NOTIFY_SOCKET")
+	_ = os.Unsetenv("WATCHDOG_USEC")
+	_ = os.Unsetenv("WATCHDOG_PID")
+	return n
+}
+
+// notify sends the newline separated variables in `state`, such as READY=1
+func (n *notifier) notify(state string) {
+	if n == nil {
+		return
+	}
+	_, _ = n.conn.Write([]byte(state))
+}
+
+// run reports readiness, once a peer completed a handshake if `waitHandshake` is set, then
+// keeps the status up to date and pings the watchdog for as long as the tunnel is ready,
+// as /readyz reports it
+func (n *notifier) run(ctx context.Context, instance *wireproxy.Instance, waitHandshake bool) {
+	if n == nil {
+		return
+	}
+
+	interval := statusInterval
+	if n.watchdog > 0 {
+		interval = n.watchdog / 2
+	}
+	ticker := time.NewTicker(min(interval, time.Second))
+	defer ticker.Stop()
+
+	ready := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		// the tunnel is gone once the instance is closed
+		tun := instance.VirtualTun()
+		if tun == nil {
+			return
+		}
+		if status, err := tun.Status(); err == nil {
+			var state string
+			if !ready && (!waitHandshake || connectedPeers(status) > 0) {
+				ready = true
+				ticker.Reset(interval)
+				state = "READY=1\n"
+			}
+			if ready {
+				state += "STATUS=" + describeStatus(status) + "\n"
+			} else {
+				state += "STATUS=Waiting for a handshake\n"
+			}
+			if n.watchdog > 0 && tun.Ready() {
+				state += "WATCHDOG=1\n"
+			}
+			n.notify(state)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// connectedPeers counts the peers which completed a handshake recently
+func connectedPeers(status *wireproxy.Status) int {
+	connected := 0
+	for _, peer := range status.Peers {
+		if peer.LatestHandshake != nil && time.Since(*peer.LatestHandshake) < handshakeTimeout {
+			connected++
+		}
+	}
+	return connected
+}
+
+// describeStatus summarizes the status in a line for systemctl status
+func describeStatus(status *wireproxy.Status) string {
+	connections := 0
+	for _, routine := range status.Routines {
+		connections += routine.Connections
+	}
+	return fmt.Sprintf("%d of %d peers connected, %d routines, %d connections",
+		connectedPeers(status), len(status.Peers), len(status.Routines), connections)
+}
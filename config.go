@@ -4,8 +4,15 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 
 	"github.com/go-ini/ini"
@@ -21,6 +28,14 @@ type PeerConfig struct {
 	AllowedIPs   []netip.Prefix
 }
 
+// routedIPs are the AllowedIPs of the peer, every address when none are given
+func (peer PeerConfig) routedIPs() []netip.Prefix {
+	if len(peer.AllowedIPs) == 0 {
+		return []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	}
+	return peer.AllowedIPs
+}
+
 // DeviceConfig contains the information to initiate a wireguard connection
 type DeviceConfig struct {
 	SecretKey          string
@@ -28,35 +43,220 @@ type DeviceConfig struct {
 	Peers              []PeerConfig
 	DNS                []netip.Addr
 	MTU                int
+	MTUDiscovery       bool
+	MSSClamp           int
 	ListenPort         *int
 	CheckAlive         []netip.Addr
 	CheckAliveInterval int
+	TUN                *TUNConfig
+	Capture            *CaptureConfig
+	Netstack           *NetstackConfig
+	Accounting         *AccountingConfig
+	UAPI               *UAPIConfig
+}
+
+// TUNConfig contains the information to bridge a host TUN device to the wireguard device
+type TUNConfig struct {
+	Name    string
+	FD      *int
+	Address []netip.Addr
+}
+
+// CaptureConfig contains the information to write tunneled packets to a pcap file
+type CaptureConfig struct {
+	File    string
+	Filter  CaptureFilter
+	MaxSize int64
+	// Stream lets anyone reaching the info server stream the decrypted packets from /capture
+	Stream bool
+}
+
+// AccountingConfig contains where the usage of authenticated users is persisted
+type AccountingConfig struct {
+	StateFile string
+}
+
+// UAPIConfig contains where the wireguard UAPI is served for tools like wg
+type UAPIConfig struct {
+	Socket string
+	Mode   os.FileMode
+	// Group owns the socket when set, so that its members can be given access with Mode
+	Group string
+	// GID is the id of Group, resolved while parsing as /etc/group can't be read once sandboxed
+	GID int
+}
+
+// NetstackConfig contains the TCP tuning parameters of netstack
+type NetstackConfig struct {
+	CongestionControl     string
+	SACK                  *bool
+	ModerateReceiveBuffer *bool
+	ReceiveBufferMax      int
+	SendBufferMax         int
+	// KeepAlive is the idle time in seconds before keepalive probes are sent, 0 disables them
+	KeepAlive         int
+	KeepAliveInterval int
+	// ForwardBufferSize is the size in bytes of the buffers copying data between forwarded connections
+	ForwardBufferSize int
+}
+
+// ConnTimeouts limits how long forwarded connections may live, in seconds.
+// 0 means no limit.
+type ConnTimeouts struct {
+	// IdleTimeout closes a connection after no data went through it in either direction
+	IdleTimeout int
+	// MaxLifetime closes a connection after it has been open for this long
+	MaxLifetime int
+}
+
+// ConnLimits restricts the connections accepted by a listener. 0 means no limit.
+type ConnLimits struct {
+	// MaxConnections is the maximum number of concurrent connections
+	MaxConnections int
+	// MaxConnectionsPerIP is the maximum number of concurrent connections from a single client address
+	MaxConnectionsPerIP int
+	// ConnectionRate is the maximum number of new connections per second
+	ConnectionRate float64
+	// Bandwidth is the maximum throughput of all connections together, in bytes per second
+	Bandwidth int
+	// ConnectionBandwidth is the maximum throughput of each connection, in bytes per second
+	ConnectionBandwidth int
+}
+
+// Quota caps the bytes an authenticated user may transfer in a period. 0 means no quota.
+type Quota struct {
+	DailyQuota   int64
+	MonthlyQuota int64
+}
+
+// LoadBalancing spreads the connections of a tunnel between several targets
+type LoadBalancing struct {
+	// Targets are the targets connections are spread between, instead of Target
+	Targets []string
+	// Balance is the policy picking the target of a connection, one of round-robin (the
+	// default), random, least-connections or failover
+	Balance string
+	// HealthCheckInterval is how often every target is checked by connecting to it, in
+	// seconds. 0 disables health checks.
+	HealthCheckInterval int
+	// HealthCheckTimeout is how long connecting to a target may take, in seconds.
+	// 0 means 5 seconds.
+	HealthCheckTimeout int
+}
+
+// SocketPermissions are applied to the unix sockets created by a listener with a
+// unix:/path BindAddress
+type SocketPermissions struct {
+	// SocketMode is the mode of the socket, 0 keeps the mode given by the umask
+	SocketMode os.FileMode
+	// SocketOwner is user, user:group or :group, resolved into SocketUID and SocketGID
+	SocketOwner string
+	SocketUID   int
+	SocketGID   int
 }
 
 type TCPClientTunnelConfig struct {
 	BindAddress *net.TCPAddr
-	Target      string
+	// UnixSocket is the path of a unix socket to listen on instead of BindAddress
+	UnixSocket string
+	// SystemdSocket is the name of a socket passed by systemd to listen on instead of BindAddress
+	SystemdSocket string
+	Target        string
+	LoadBalancing
+	ConnTimeouts
+	ConnLimits
+	SocketPermissions
+	// group is shared by the tunnels expanded from a section with several ports
+	group *routineGroup
+}
+
+// bindAddress is where the tunnel listens, as written in BindAddress
+func (conf *TCPClientTunnelConfig) bindAddress() string {
+	if conf.UnixSocket != "" {
+		return "unix:" + conf.UnixSocket
+	}
+	if conf.BindAddress != nil {
+		return conf.BindAddress.String()
+	}
+	return ""
 }
 
 type STDIOTunnelConfig struct {
 	Target string
+	ConnTimeouts
 }
 
 type TCPServerTunnelConfig struct {
 	ListenPort int
 	Target     string
+	LoadBalancing
+	ConnTimeouts
+	ConnLimits
+	// group is shared by the tunnels expanded from a section with several ports
+	group *routineGroup
 }
 
 type Socks5Config struct {
-	BindAddress string
-	Username    string
-	Password    string
+	BindAddress   string
+	SystemdSocket string
+	Username      string
+	Password      string
+	ConnTimeouts
+	ConnLimits
+	Quota
+	SocketPermissions
 }
 
 type HTTPConfig struct {
+	BindAddress   string
+	SystemdSocket string
+	Username      string
+	Password      string
+	ConnTimeouts
+	ConnLimits
+	Quota
+	SocketPermissions
+}
+
+// DestinationACL restricts the hosts of the local network which wireguard peers may
+// reach through a reverse proxy
+type DestinationACL struct {
+	// AllowedIPs are the networks connections may go to
+	AllowedIPs []netip.Prefix
+	// AllowedPorts are the ports connections may go to, any port when empty
+	AllowedPorts []uint16
+}
+
+// ReverseProxyConfig are the settings shared by the proxies listening on wireguard
+type ReverseProxyConfig struct {
+	ListenPort int
+	Username   string
+	Password   string
+	DestinationACL
+	ConnTimeouts
+	ConnLimits
+	Quota
+}
+
+// Socks5ServerConfig is a socks5 server listening on wireguard, which connects peers
+// to the local network
+type Socks5ServerConfig struct {
+	ReverseProxyConfig
+}
+
+// HTTPServerConfig is a http proxy listening on wireguard, which connects peers
+// to the local network
+type HTTPServerConfig struct {
+	ReverseProxyConfig
+}
+
+type TransparentProxyConfig struct {
 	BindAddress string
-	Username    string
-	Password    string
+	Mode        string
+	// UDP also relays UDP packets, which is only possible with TPROXY as REDIRECT
+	// can't recover their original destination
+	UDP bool
+	ConnTimeouts
 }
 
 type Configuration struct {
@@ -64,24 +264,137 @@ type Configuration struct {
 	Routines []RoutineSpawner
 }
 
+// referencePrefixes start the values which don't stand for themselves, see parseString
+var referencePrefixes = []string{"$", "file:", "exec:", `\`}
+
+// isReference tells whether `value` starts with one of referencePrefixes
+func isReference(value string) bool {
+	for _, prefix := range referencePrefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeLiteral makes parseString return `value` itself
+func escapeLiteral(value string) string {
+	if isReference(value) {
+		return `\` + value
+	}
+	return value
+}
+
+// parseString returns the value of a key, which may reference an environment variable ($NAME)
+// or the content of a file (file:path). A leading backslash makes the rest of the value literal,
+// e.g. \file:path. exec:command references are replaced by the output of the command beforehand,
+// see runCommands.
 func parseString(section *ini.Section, keyName string) (string, error) {
 	key := section.Key(strings.ToLower(keyName))
 	if key == nil {
 		return "", errors.New(keyName + " should not be empty")
 	}
 	value := key.String()
-	if strings.HasPrefix(value, "$") {
-		if strings.HasPrefix(value, "$$") {
-			return strings.Replace(value, "$$", "$", 1), nil
-		}
+	switch {
+	case strings.HasPrefix(value, `\`) && isReference(value[1:]):
+		return value[1:], nil
+	case strings.HasPrefix(value, "$$"):
+		return strings.Replace(value, "$$", "$", 1), nil
+	case strings.HasPrefix(value, "$"):
 		var ok bool
 		value, ok = os.LookupEnv(strings.TrimPrefix(value, "$"))
 		if !ok {
-			return "", errors.New(keyName + " references unset environment variable " + key.String())
+			return "", keyError(keyName, errors.New(keyName+" references unset environment variable "+key.String()))
 		}
 		return value, nil
+	case strings.HasPrefix(value, "file:"):
+		value, err := readSecretFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", keyError(keyName, err)
+		}
+		return value, nil
+	}
+	return value, nil
+}
+
+// ParseOption customizes the parsing of a configuration
+type ParseOption func(*parseOptions)
+
+type parseOptions struct {
+	commands bool
+}
+
+// WithCommands runs the commands of exec:command references. Without it, such references are
+// rejected, as the configuration could run anything with the privileges of the caller.
+func WithCommands() ParseOption {
+	return func(options *parseOptions) {
+		options.commands = true
+	}
+}
+
+// runCommands replaces the exec:command references of `cfg` by the output of their command,
+// or rejects them unless `allowed`
+func runCommands(cfg *ini.File, allowed bool) error {
+	for _, section := range cfg.Sections() {
+		for _, key := range section.Keys() {
+			command, ok := strings.CutPrefix(strings.TrimSpace(key.String()), "exec:")
+			if !ok {
+				continue
+			}
+			if !allowed {
+				return sectionError(section, keyError(key.Name(), errors.New("running commands is not enabled, see WithCommands")))
+			}
+			value, err := execSecretCommand(command)
+			if err != nil {
+				return sectionError(section, keyError(key.Name(), err))
+			}
+			key.SetValue(escapeLiteral(value))
+		}
+	}
+	return nil
+}
+
+// readSecretFile reads a secret from a file, such as a systemd credential or a docker secret.
+// Environment variables in the path are expanded, e.g. file:$CREDENTIALS_DIRECTORY/private-key
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(os.ExpandEnv(strings.TrimSpace(path)))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// execSecretCommand runs a command with the shell and returns its output as a secret
+func execSecretCommand(command string) (string, error) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", errors.New("failed to run " + command + ": " + err.Error())
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// parseSecret returns the value of a key which may be given either inline or, with
+// the File suffix, as the path of a file holding it, e.g. PrivateKey or PrivateKeyFile
+func parseSecret(section *ini.Section, keyName string) (string, error) {
+	fileKeyName := keyName + "File"
+	if !section.HasKey(fileKeyName) {
+		return parseString(section, keyName)
+	}
+	if section.HasKey(keyName) {
+		return "", keyError(fileKeyName, errors.New(keyName+" and "+fileKeyName+" are mutually exclusive"))
+	}
+
+	path, err := parseString(section, fileKeyName)
+	if err != nil {
+		return "", err
+	}
+	value, err := readSecretFile(path)
+	if err != nil {
+		return "", keyError(fileKeyName, err)
 	}
-	return key.String(), nil
+	return value, nil
 }
 
 func parsePort(section *ini.Section, keyName string) (int, error) {
@@ -92,11 +405,11 @@ func parsePort(section *ini.Section, keyName string) (int, error) {
 
 	port, err := key.Int()
 	if err != nil {
-		return 0, err
+		return 0, keyError(keyName, err)
 	}
 
 	if !(port >= 0 && port < 65536) {
-		return 0, errors.New("port should be >= 0 and < 65536")
+		return 0, keyError(keyName, errors.New("port should be >= 0 and < 65536"))
 	}
 
 	return port, nil
@@ -107,17 +420,21 @@ func parseTCPAddr(section *ini.Section, keyName string) (*net.TCPAddr, error) {
 	if err != nil {
 		return nil, err
 	}
-	return net.ResolveTCPAddr("tcp", addrStr)
+	addr, err := net.ResolveTCPAddr("tcp", addrStr)
+	if err != nil {
+		return nil, keyError(keyName, err)
+	}
+	return addr, nil
 }
 
 func parseBase64KeyToHex(section *ini.Section, keyName string) (string, error) {
-	key, err := parseString(section, keyName)
+	key, err := parseSecret(section, keyName)
 	if err != nil {
 		return "", err
 	}
 	result, err := encodeBase64ToHex(key)
 	if err != nil {
-		return result, err
+		return result, keyError(keyName, err)
 	}
 
 	return result, nil
@@ -152,7 +469,7 @@ func parseNetIP(section *ini.Section, keyName string) ([]netip.Addr, error) {
 		}
 		ip, err := netip.ParseAddr(str)
 		if err != nil {
-			return nil, err
+			return nil, keyError(keyName, err)
 		}
 		ips = append(ips, ip)
 	}
@@ -181,7 +498,7 @@ func parseCIDRNetIP(section *ini.Section, keyName string) ([]netip.Addr, error)
 		} else {
 			prefix, err := netip.ParsePrefix(str)
 			if err != nil {
-				return nil, err
+				return nil, keyError(keyName, err)
 			}
       
 			addr := prefix.Addr()
@@ -209,7 +526,7 @@ func parseAllowedIPs(section *ini.Section) ([]netip.Prefix, error) {
 		}
 		prefix, err := netip.ParsePrefix(str)
 		if err != nil {
-			return nil, err
+			return nil, keyError("AllowedIPs", err)
 		}
 
 		ips = append(ips, prefix)
@@ -217,6 +534,130 @@ func parseAllowedIPs(section *ini.Section) ([]netip.Prefix, error) {
 	return ips, nil
 }
 
+// isPortList checks whether the port of an address is a list or range of ports
+func isPortList(port string) bool {
+	return strings.ContainsAny(port, ",-")
+}
+
+// maxPortListSize is the largest number of ports a list of ports may expand to
+const maxPortListSize = 1024
+
+// parsePortList parses a comma separated list of ports and ranges of ports, such as 80, 8000-8050
+func parsePortList(str string) ([]int, error) {
+	var ports []int
+	seen := map[uint64]bool{}
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(item, "-")
+		from, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s: %w", item, err)
+		}
+		to := from
+		if isRange {
+			to, err = strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %s: %w", item, err)
+			}
+			if to < from {
+				return nil, fmt.Errorf("invalid port range %s", item)
+			}
+		}
+		for port := from; port <= to; port++ {
+			if seen[port] {
+				return nil, fmt.Errorf("port %d is given more than once", port)
+			}
+			seen[port] = true
+			if len(ports) == maxPortListSize {
+				return nil, fmt.Errorf("too many ports, at most %d can be given", maxPortListSize)
+			}
+			ports = append(ports, int(port))
+		}
+	}
+	if len(ports) == 0 {
+		return nil, errors.New("no port given")
+	}
+	return ports, nil
+}
+
+// expandTargets gives the targets of each of `count` listening ports, from a comma
+// separated list of targets with either a single port or one port for each listening
+// port, such as host:8000-8050, other-host:8000-8050
+func expandTargets(target string, count int) ([][]string, error) {
+	targets := make([][]string, count)
+	for _, item := range splitTargets(target) {
+		expanded, err := expandTarget(item, count)
+		if err != nil {
+			return nil, err
+		}
+		for i := range targets {
+			targets[i] = append(targets[i], expanded[i])
+		}
+	}
+	return targets, nil
+}
+
+// splitTargets splits a list of targets, where items without a host are ports of the
+// previous target
+func splitTargets(target string) []string {
+	var targets []string
+	for _, item := range strings.Split(target, ",") {
+		item = strings.TrimSpace(item)
+		if len(targets) > 0 && item != "" && !strings.Contains(item, ":") {
+			targets[len(targets)-1] += ", " + item
+			continue
+		}
+		if item != "" || len(targets) == 0 {
+			targets = append(targets, item)
+		}
+	}
+	return targets
+}
+
+// expandTarget gives the target of each of `count` listening ports
+func expandTarget(target string, count int) ([]string, error) {
+	host, portList, err := net.SplitHostPort(target)
+	if err != nil {
+		// a single target is only checked once the tunnel starts
+		if count == 1 {
+			return []string{target}, nil
+		}
+		return nil, err
+	}
+
+	ports := []string{portList}
+	if isPortList(portList) {
+		list, err := parsePortList(portList)
+		if err != nil {
+			return nil, err
+		}
+		ports = ports[:0]
+		for _, port := range list {
+			ports = append(ports, strconv.Itoa(port))
+		}
+	}
+	if len(ports) != 1 && len(ports) != count {
+		return nil, fmt.Errorf("%d target ports given for %d listening ports", len(ports), count)
+	}
+
+	targets := make([]string, count)
+	for i := range targets {
+		targets[i] = net.JoinHostPort(host, ports[min(i, len(ports)-1)])
+	}
+	return targets, nil
+}
+
+// oneOrMany sets either Target or LoadBalancing.Targets, when there are several targets
+func oneOrMany(targets []string) (string, []string) {
+	if len(targets) == 1 {
+		return targets[0], nil
+	}
+	return "", targets
+}
+
 func resolveIP(ip string) (*net.IPAddr, error) {
 	return net.ResolveIPAddr("ip", ip)
 }
@@ -262,17 +703,32 @@ func ParseInterface(cfg *ini.File, device *DeviceConfig) error {
 	device.DNS = dns
 
 	if sectionKey, err := section.GetKey("MTU"); err == nil {
+		if strings.EqualFold(sectionKey.String(), "auto") {
+			device.MTUDiscovery = true
+		} else {
+			value, err := sectionKey.Int()
+			if err != nil {
+				return keyError("MTU", err)
+			}
+			device.MTU = value
+		}
+	}
+
+	if sectionKey, err := section.GetKey("MSSClamp"); err == nil {
 		value, err := sectionKey.Int()
 		if err != nil {
-			return err
+			return keyError("MSSClamp", err)
+		}
+		if value < 536 || value > 65535 {
+			return errors.New("MSSClamp should be >= 536 and < 65536")
 		}
-		device.MTU = value
+		device.MSSClamp = value
 	}
 
 	if sectionKey, err := section.GetKey("ListenPort"); err == nil {
 		value, err := sectionKey.Int()
 		if err != nil {
-			return err
+			return keyError("ListenPort", err)
 		}
 		device.ListenPort = &value
 	}
@@ -287,7 +743,7 @@ func ParseInterface(cfg *ini.File, device *DeviceConfig) error {
 	if sectionKey, err := section.GetKey("CheckAliveInterval"); err == nil {
 		value, err := sectionKey.Int()
 		if err != nil {
-			return err
+			return keyError("CheckAliveInterval", err)
 		}
 		if len(checkAlive) == 0 {
 			return errors.New("CheckAliveInterval is only valid when CheckAlive is set")
@@ -296,6 +752,10 @@ func ParseInterface(cfg *ini.File, device *DeviceConfig) error {
 		device.CheckAliveInterval = value
 	}
 
+	if device.MTUDiscovery && len(checkAlive) == 0 {
+		return errors.New("MTU = auto is only valid when CheckAlive is set")
+	}
+
 	return nil
 }
 
@@ -307,219 +767,1130 @@ func ParsePeers(cfg *ini.File, peers *[]PeerConfig) error {
 	}
 
 	for _, section := range sections {
-		peer := PeerConfig{
-			PreSharedKey: "0000000000000000000000000000000000000000000000000000000000000000",
-			KeepAlive:    0,
-		}
-
-		decoded, err := parseBase64KeyToHex(section, "PublicKey")
+		peer, err := parsePeer(section)
 		if err != nil {
-			return err
+			return sectionError(section, err)
 		}
-		peer.PublicKey = decoded
 
-		if sectionKey, err := section.GetKey("PreSharedKey"); err == nil {
-			value, err := encodeBase64ToHex(sectionKey.String())
-			if err != nil {
-				return err
-			}
-			peer.PreSharedKey = value
-		}
+		*peers = append(*peers, peer)
+	}
+	return nil
+}
 
-		if value, err := parseString(section, "Endpoint"); err == nil {
-			decoded, err = resolveIPPAndPort(strings.ToLower(value))
-			if err != nil {
-				return err
-			}
-			peer.Endpoint = &decoded
-		}
+func parsePeer(section *ini.Section) (PeerConfig, error) {
+	peer := PeerConfig{
+		PreSharedKey: "0000000000000000000000000000000000000000000000000000000000000000",
+		KeepAlive:    0,
+	}
 
-		if sectionKey, err := section.GetKey("PersistentKeepalive"); err == nil {
-			value, err := sectionKey.Int()
-			if err != nil {
-				return err
-			}
-			peer.KeepAlive = value
-		}
+	decoded, err := parseBase64KeyToHex(section, "PublicKey")
+	if err != nil {
+		return peer, err
+	}
+	peer.PublicKey = decoded
 
-		peer.AllowedIPs, err = parseAllowedIPs(section)
+	if section.HasKey("PreSharedKey") || section.HasKey("PreSharedKeyFile") {
+		value, err := parseBase64KeyToHex(section, "PreSharedKey")
 		if err != nil {
-			return err
+			return peer, err
 		}
+		peer.PreSharedKey = value
+	}
 
-		*peers = append(*peers, peer)
+	if value, err := parseString(section, "Endpoint"); err == nil {
+		decoded, err = resolveIPPAndPort(strings.ToLower(value))
+		if err != nil {
+			return peer, keyError("Endpoint", err)
+		}
+		peer.Endpoint = &decoded
 	}
-	return nil
-}
 
-func parseTCPClientTunnelConfig(section *ini.Section) (RoutineSpawner, error) {
-	config := &TCPClientTunnelConfig{}
-	tcpAddr, err := parseTCPAddr(section, "BindAddress")
-	if err != nil {
-		return nil, err
+	if sectionKey, err := section.GetKey("PersistentKeepalive"); err == nil {
+		value, err := sectionKey.Int()
+		if err != nil {
+			return peer, keyError("PersistentKeepalive", err)
+		}
+		peer.KeepAlive = value
 	}
-	config.BindAddress = tcpAddr
 
-	targetSection, err := parseString(section, "Target")
+	peer.AllowedIPs, err = parseAllowedIPs(section)
 	if err != nil {
-		return nil, err
+		return peer, err
 	}
-	config.Target = targetSection
 
-	return config, nil
+	return peer, nil
 }
 
-func parseSTDIOTunnelConfig(section *ini.Section) (RoutineSpawner, error) {
-	config := &STDIOTunnelConfig{}
-	targetSection, err := parseString(section, "Target")
+// ParseTUN parses the optional [TUN] section and extract the information into `device`
+func ParseTUN(cfg *ini.File, device *DeviceConfig) error {
+	sections, err := cfg.SectionsByName("TUN")
 	if err != nil {
-		return nil, err
+		return nil
 	}
-	config.Target = targetSection
-
-	return config, nil
-}
+	if len(sections) != 1 {
+		return errors.New("at most one [TUN] is expected")
+	}
+	section := sections[0]
 
-func parseTCPServerTunnelConfig(section *ini.Section) (RoutineSpawner, error) {
-	config := &TCPServerTunnelConfig{}
+	config := &TUNConfig{}
 
-	listenPort, err := parsePort(section, "ListenPort")
+	name, err := parseString(section, "Name")
 	if err != nil {
-		return nil, err
+		return err
 	}
-	config.ListenPort = listenPort
+	config.Name = name
 
-	target, err := parseString(section, "Target")
-	if err != nil {
-		return nil, err
+	if sectionKey, err := section.GetKey("FD"); err == nil {
+		value, err := sectionKey.Int()
+		if err != nil {
+			return keyError("FD", err)
+		}
+		if value < 0 {
+			return errors.New("FD should be >= 0")
+		}
+		config.FD = &value
 	}
-	config.Target = target
 
-	return config, nil
-}
-
-func parseSocks5Config(section *ini.Section) (RoutineSpawner, error) {
-	config := &Socks5Config{}
+	if (config.Name == "") == (config.FD == nil) {
+		return errors.New("one and only one of Name and FD should be set in [TUN]")
+	}
 
-	bindAddress, err := parseString(section, "BindAddress")
+	address, err := parseCIDRNetIP(section, "Address")
 	if err != nil {
-		return nil, err
+		return err
 	}
-	config.BindAddress = bindAddress
-
-	username, _ := parseString(section, "Username")
-	config.Username = username
-
-	password, _ := parseString(section, "Password")
-	config.Password = password
+	if len(address) == 0 {
+		return errors.New("Address should not be empty in [TUN]")
+	}
+	config.Address = address
 
-	return config, nil
+	device.TUN = config
+	return nil
 }
 
-func parseHTTPConfig(section *ini.Section) (RoutineSpawner, error) {
-	config := &HTTPConfig{}
-
-	bindAddress, err := parseString(section, "BindAddress")
+// ParseCapture parses the optional [Capture] section and extract the information into `device`
+func ParseCapture(cfg *ini.File, device *DeviceConfig) error {
+	sections, err := cfg.SectionsByName("Capture")
 	if err != nil {
-		return nil, err
+		return nil
 	}
-	config.BindAddress = bindAddress
+	if len(sections) != 1 {
+		return errors.New("at most one [Capture] is expected")
+	}
+	section := sections[0]
 
-	username, _ := parseString(section, "Username")
-	config.Username = username
+	config := &CaptureConfig{}
 
-	password, _ := parseString(section, "Password")
-	config.Password = password
+	file, err := parseString(section, "File")
+	if err != nil {
+		return err
+	}
+	config.File = file
 
-	return config, nil
-}
+	stream, err := parseBool(section, "Stream")
+	if err != nil {
+		return err
+	}
+	config.Stream = stream != nil && *stream
+	if file == "" && !config.Stream {
+		return errors.New("File should not be empty in [Capture] unless Stream is enabled")
+	}
 
-// Takes a function that parses an individual section into a config, and apply it on all
-// specified sections
-func parseRoutinesConfig(routines *[]RoutineSpawner, cfg *ini.File, sectionName string, f func(*ini.Section) (RoutineSpawner, error)) error {
-	sections, err := cfg.SectionsByName(sectionName)
+	hosts, err := parseString(section, "Host")
 	if err != nil {
-		return nil
+		return err
+	}
+	ports, err := parseString(section, "Port")
+	if err != nil {
+		return err
+	}
+	config.Filter, err = parseCaptureFilter(hosts, ports)
+	if err != nil {
+		return err
 	}
 
-	for _, section := range sections {
-		config, err := f(section)
+	if sectionKey, err := section.GetKey("MaxSize"); err == nil {
+		value, err := sectionKey.Int64()
 		if err != nil {
-			return err
+			return keyError("MaxSize", err)
 		}
-
-		*routines = append(*routines, config)
+		if value < 0 {
+			return errors.New("MaxSize should be >= 0")
+		}
+		config.MaxSize = value
 	}
 
+	device.Capture = config
 	return nil
 }
 
-// ParseConfig takes the path of a configuration file and parses it into Configuration
-func ParseConfig(path string) (*Configuration, error) {
-	iniOpt := ini.LoadOptions{
-		Insensitive:            true,
-		AllowShadows:           true,
-		AllowNonUniqueSections: true,
+func parseBool(section *ini.Section, keyName string) (*bool, error) {
+	sectionKey, err := section.GetKey(keyName)
+	if err != nil {
+		return nil, nil
+	}
+	value, err := sectionKey.Bool()
+	if err != nil {
+		return nil, keyError(keyName, errors.New(keyName+" should be true or false"))
+	}
+	return &value, nil
+}
+
+// ParseAccounting parses the optional [Accounting] section and extract the information into `device`
+func ParseAccounting(cfg *ini.File, device *DeviceConfig) error {
+	sections, err := cfg.SectionsByName("Accounting")
+	if err != nil {
+		return nil
+	}
+	if len(sections) != 1 {
+		return errors.New("at most one [Accounting] is expected")
+	}
+
+	stateFile, err := parseString(sections[0], "StateFile")
+	if err != nil {
+		return err
+	}
+	if stateFile == "" {
+		return errors.New("StateFile should not be empty")
+	}
+
+	device.Accounting = &AccountingConfig{StateFile: stateFile}
+	return nil
+}
+
+// ParseUAPI parses the optional [UAPI] section and extract the information into `device`
+func ParseUAPI(cfg *ini.File, device *DeviceConfig) error {
+	sections, err := cfg.SectionsByName("UAPI")
+	if err != nil {
+		return nil
+	}
+	if len(sections) != 1 {
+		return errors.New("at most one [UAPI] is expected")
+	}
+	section := sections[0]
+
+	config := &UAPIConfig{Mode: 0600}
+
+	config.Socket, err = parseString(section, "Socket")
+	if err != nil {
+		return err
+	}
+	if config.Socket == "" {
+		return errors.New("Socket should not be empty in [UAPI]")
+	}
+
+	if mode, err := parseFileMode(section, "Mode"); err != nil {
+		return err
+	} else if mode != nil {
+		config.Mode = *mode
+	}
+
+	config.Group, err = parseString(section, "Group")
+	if err != nil {
+		return err
+	}
+	config.GID = -1
+	if config.Group != "" {
+		config.GID, err = lookupGID(config.Group)
+		if err != nil {
+			return keyError("Group", err)
+		}
+	}
+
+	device.UAPI = config
+	return nil
+}
+
+// ParseNetstack parses the optional [Netstack] section and extract the information into `device`
+func ParseNetstack(cfg *ini.File, device *DeviceConfig) error {
+	sections, err := cfg.SectionsByName("Netstack")
+	if err != nil {
+		return nil
+	}
+	if len(sections) != 1 {
+		return errors.New("at most one [Netstack] is expected")
+	}
+	section := sections[0]
+
+	config := &NetstackConfig{}
+
+	congestionControl, err := parseString(section, "CongestionControl")
+	if err != nil {
+		return err
+	}
+	congestionControl = strings.ToLower(congestionControl)
+	if congestionControl != "" && congestionControl != "reno" && congestionControl != "cubic" {
+		return errors.New("CongestionControl should be either reno or cubic")
+	}
+	config.CongestionControl = congestionControl
+
+	config.SACK, err = parseBool(section, "SACK")
+	if err != nil {
+		return err
+	}
+
+	config.ModerateReceiveBuffer, err = parseBool(section, "ModerateReceiveBuffer")
+	if err != nil {
+		return err
+	}
+
+	for keyName, value := range map[string]*int{
+		"ReceiveBufferMax":  &config.ReceiveBufferMax,
+		"SendBufferMax":     &config.SendBufferMax,
+		"KeepAlive":         &config.KeepAlive,
+		"KeepAliveInterval": &config.KeepAliveInterval,
+		"ForwardBufferSize": &config.ForwardBufferSize,
+	} {
+		if sectionKey, err := section.GetKey(keyName); err == nil {
+			*value, err = sectionKey.Int()
+			if err != nil {
+				return keyError(keyName, err)
+			}
+			if *value < 0 {
+				return keyError(keyName, errors.New(keyName+" should be >= 0"))
+			}
+		}
+	}
+
+	if config.KeepAliveInterval == 0 {
+		config.KeepAliveInterval = 75
+	}
+
+	device.Netstack = config
+	return nil
+}
+
+// parseFileMode parses octal permissions such as 0660
+func parseFileMode(section *ini.Section, keyName string) (*os.FileMode, error) {
+	sectionKey, err := section.GetKey(keyName)
+	if err != nil {
+		return nil, nil
+	}
+	mode, err := strconv.ParseUint(sectionKey.String(), 8, 32)
+	if err != nil || mode > 0777 {
+		return nil, keyError(keyName, errors.New(keyName+" should be octal permissions such as 0660"))
+	}
+	fileMode := os.FileMode(mode)
+	return &fileMode, nil
+}
+
+// lookupUID resolves a user name or id, while /etc/passwd can still be read
+func lookupUID(name string) (int, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		u, err = user.LookupId(name)
+	}
+	if err != nil {
+		return -1, errors.New("unknown user " + name)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGID resolves a group name or id, while /etc/group can still be read
+func lookupGID(name string) (int, error) {
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		group, err = user.LookupGroupId(name)
+	}
+	if err != nil {
+		return -1, errors.New("unknown group " + name)
+	}
+	return strconv.Atoi(group.Gid)
+}
+
+// parseSocketPermissions parses the permissions of unix sockets created by a listener
+func parseSocketPermissions(section *ini.Section) (SocketPermissions, error) {
+	perms := SocketPermissions{SocketUID: -1, SocketGID: -1}
+
+	mode, err := parseFileMode(section, "SocketMode")
+	if err != nil {
+		return perms, err
+	}
+	if mode != nil {
+		perms.SocketMode = *mode
+	}
+
+	perms.SocketOwner, err = parseString(section, "SocketOwner")
+	if err != nil {
+		return perms, err
+	}
+	if perms.SocketOwner == "" {
+		return perms, nil
+	}
+	// same syntax as chown: user, user:group or :group
+	userName, groupName, _ := strings.Cut(perms.SocketOwner, ":")
+	if userName != "" {
+		if perms.SocketUID, err = lookupUID(userName); err != nil {
+			return perms, keyError("SocketOwner", err)
+		}
+	}
+	if groupName != "" {
+		if perms.SocketGID, err = lookupGID(groupName); err != nil {
+			return perms, keyError("SocketOwner", err)
+		}
+	}
+	return perms, nil
+}
+
+func parseLoadBalancing(section *ini.Section) (LoadBalancing, error) {
+	var lb LoadBalancing
+
+	lb.Balance = BalanceRoundRobin
+	if balance, err := parseString(section, "Balance"); err == nil && balance != "" {
+		balance = strings.ToLower(balance)
+		switch balance {
+		case BalanceRoundRobin, BalanceRandom, BalanceLeastConnections, BalanceFailover:
+		default:
+			return lb, keyError("Balance", errors.New("Balance should be round-robin, random, least-connections or failover"))
+		}
+		lb.Balance = balance
+	}
+
+	for keyName, value := range map[string]*int{
+		"HealthCheckInterval": &lb.HealthCheckInterval,
+		"HealthCheckTimeout":  &lb.HealthCheckTimeout,
+	} {
+		if sectionKey, err := section.GetKey(keyName); err == nil {
+			*value, err = sectionKey.Int()
+			if err != nil {
+				return lb, keyError(keyName, err)
+			}
+			if *value < 0 {
+				return lb, keyError(keyName, errors.New(keyName+" should be >= 0"))
+			}
+		}
+	}
+
+	return lb, nil
+}
+
+func parseConnTimeouts(section *ini.Section) (ConnTimeouts, error) {
+	var timeouts ConnTimeouts
+	for keyName, value := range map[string]*int{
+		"IdleTimeout": &timeouts.IdleTimeout,
+		"MaxLifetime": &timeouts.MaxLifetime,
+	} {
+		if sectionKey, err := section.GetKey(keyName); err == nil {
+			*value, err = sectionKey.Int()
+			if err != nil {
+				return timeouts, keyError(keyName, err)
+			}
+			if *value < 0 {
+				return timeouts, keyError(keyName, errors.New(keyName+" should be >= 0"))
+			}
+		}
+	}
+	return timeouts, nil
+}
+
+func parseConnLimits(section *ini.Section) (ConnLimits, error) {
+	var limits ConnLimits
+	for keyName, value := range map[string]*int{
+		"MaxConnections":      &limits.MaxConnections,
+		"MaxConnectionsPerIP": &limits.MaxConnectionsPerIP,
+		"Bandwidth":           &limits.Bandwidth,
+		"ConnectionBandwidth": &limits.ConnectionBandwidth,
+	} {
+		if sectionKey, err := section.GetKey(keyName); err == nil {
+			*value, err = sectionKey.Int()
+			if err != nil {
+				return limits, keyError(keyName, err)
+			}
+			if *value < 0 {
+				return limits, keyError(keyName, errors.New(keyName+" should be >= 0"))
+			}
+		}
+	}
+
+	if sectionKey, err := section.GetKey("ConnectionRate"); err == nil {
+		limits.ConnectionRate, err = sectionKey.Float64()
+		if err != nil {
+			return limits, keyError("ConnectionRate", err)
+		}
+		if limits.ConnectionRate < 0 {
+			return limits, errors.New("ConnectionRate should be >= 0")
+		}
 	}
 
-	cfg, err := ini.LoadSources(iniOpt, path)
+	return limits, nil
+}
+
+func parseQuota(section *ini.Section, username string) (Quota, error) {
+	var quota Quota
+	for keyName, value := range map[string]*int64{
+		"DailyQuota":   &quota.DailyQuota,
+		"MonthlyQuota": &quota.MonthlyQuota,
+	} {
+		if sectionKey, err := section.GetKey(keyName); err == nil {
+			*value, err = sectionKey.Int64()
+			if err != nil {
+				return quota, keyError(keyName, err)
+			}
+			if *value < 0 {
+				return quota, keyError(keyName, errors.New(keyName+" should be >= 0"))
+			}
+		}
+	}
+
+	if quota != (Quota{}) && username == "" {
+		return quota, errors.New("quotas require a Username")
+	}
+	return quota, nil
+}
+
+// parseTCPClientTunnelConfig parses a [TCPClientTunnel], which is expanded into a tunnel
+// for each port when BindAddress has a list of ports
+func parseTCPClientTunnelConfig(section *ini.Section) ([]RoutineSpawner, error) {
+	config := &TCPClientTunnelConfig{}
+	systemdSocket, err := parseSystemdSocket(section)
 	if err != nil {
 		return nil, err
 	}
+	config.SystemdSocket = systemdSocket
 
-	device := &DeviceConfig{
-		MTU: 1420,
+	var bindAddresses []*net.TCPAddr
+	if systemdSocket == "" {
+		bindAddress, err := parseString(section, "BindAddress")
+		if err != nil {
+			return nil, err
+		}
+		if path, ok := strings.CutPrefix(bindAddress, "unix:"); ok {
+			config.UnixSocket = path
+		} else if host, portList, err := net.SplitHostPort(bindAddress); err == nil && isPortList(portList) {
+			ports, err := parsePortList(portList)
+			if err != nil {
+				return nil, keyError("BindAddress", err)
+			}
+			addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, "0"))
+			if err != nil {
+				return nil, keyError("BindAddress", err)
+			}
+			for _, port := range ports {
+				bindAddresses = append(bindAddresses, &net.TCPAddr{IP: addr.IP, Port: port, Zone: addr.Zone})
+			}
+			config.group = &routineGroup{name: "TCPClientTunnel " + bindAddress}
+		} else {
+			tcpAddr, err := parseTCPAddr(section, "BindAddress")
+			if err != nil {
+				return nil, err
+			}
+			config.BindAddress = tcpAddr
+		}
 	}
 
-	root := cfg.Section("")
-	wgConf, err := root.GetKey("WGConfig")
-	wgCfg := cfg
-	if err == nil {
-		wgCfg, err = ini.LoadSources(iniOpt, wgConf.String())
+	config.SocketPermissions, err = parseSocketPermissions(section)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := parseString(section, "Target")
+	if err != nil {
+		return nil, err
+	}
+	targets, err := expandTargets(target, max(len(bindAddresses), 1))
+	if err != nil {
+		return nil, keyError("Target", err)
+	}
+
+	config.LoadBalancing, err = parseLoadBalancing(section)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ConnTimeouts, err = parseConnTimeouts(section)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ConnLimits, err = parseConnLimits(section)
+	if err != nil {
+		return nil, err
+	}
+
+	if bindAddresses == nil {
+		config.Target, config.Targets = oneOrMany(targets[0])
+		return []RoutineSpawner{config}, nil
+	}
+	tunnels := make([]RoutineSpawner, 0, len(bindAddresses))
+	for i, bindAddress := range bindAddresses {
+		tunnel := *config
+		tunnel.BindAddress = bindAddress
+		tunnel.Target, tunnel.Targets = oneOrMany(targets[i])
+		tunnels = append(tunnels, &tunnel)
+	}
+	return tunnels, nil
+}
+
+// parseSystemdSocket parses the name of a socket passed by systemd, which replaces BindAddress
+func parseSystemdSocket(section *ini.Section) (string, error) {
+	name, err := parseString(section, "SystemdSocket")
+	if err != nil {
+		return "", err
+	}
+	if name != "" && section.HasKey("BindAddress") {
+		return "", errors.New("only one of BindAddress and SystemdSocket should be set")
+	}
+	return name, nil
+}
+
+func parseSTDIOTunnelConfig(section *ini.Section) (RoutineSpawner, error) {
+	config := &STDIOTunnelConfig{}
+	targetSection, err := parseString(section, "Target")
+	if err != nil {
+		return nil, err
+	}
+	config.Target = targetSection
+
+	config.ConnTimeouts, err = parseConnTimeouts(section)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// parseTCPServerTunnelConfig parses a [TCPServerTunnel], which is expanded into a tunnel
+// for each port when ListenPort is a list of ports
+func parseTCPServerTunnelConfig(section *ini.Section) ([]RoutineSpawner, error) {
+	config := &TCPServerTunnelConfig{}
+
+	portList, err := parseString(section, "ListenPort")
+	if err != nil {
+		return nil, err
+	}
+	var listenPorts []int
+	if isPortList(portList) {
+		ports, err := parsePortList(portList)
+		if err != nil {
+			return nil, keyError("ListenPort", err)
+		}
+		listenPorts = ports
+		config.group = &routineGroup{name: "TCPServerTunnel " + portList}
+	} else {
+		listenPort, err := strconv.Atoi(portList)
+		if err != nil {
+			return nil, keyError("ListenPort", err)
+		}
+		if !(listenPort >= 0 && listenPort < 65536) {
+			return nil, keyError("ListenPort", errors.New("port should be >= 0 and < 65536"))
+		}
+		listenPorts = []int{listenPort}
+	}
+
+	target, err := parseString(section, "Target")
+	if err != nil {
+		return nil, err
+	}
+	targets, err := expandTargets(target, len(listenPorts))
+	if err != nil {
+		return nil, keyError("Target", err)
+	}
+
+	config.LoadBalancing, err = parseLoadBalancing(section)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ConnTimeouts, err = parseConnTimeouts(section)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ConnLimits, err = parseConnLimits(section)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnels := make([]RoutineSpawner, 0, len(listenPorts))
+	for i, listenPort := range listenPorts {
+		tunnel := *config
+		tunnel.ListenPort = listenPort
+		tunnel.Target, tunnel.Targets = oneOrMany(targets[i])
+		tunnels = append(tunnels, &tunnel)
+	}
+	return tunnels, nil
+}
+
+func parseSocks5Config(section *ini.Section) (RoutineSpawner, error) {
+	config := &Socks5Config{}
+
+	systemdSocket, err := parseSystemdSocket(section)
+	if err != nil {
+		return nil, err
+	}
+	config.SystemdSocket = systemdSocket
+
+	if systemdSocket == "" {
+		config.BindAddress, err = parseString(section, "BindAddress")
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	err = ParseInterface(wgCfg, device)
+	config.SocketPermissions, err = parseSocketPermissions(section)
 	if err != nil {
 		return nil, err
 	}
 
-	err = ParsePeers(wgCfg, &device.Peers)
+	config.Username, err = parseString(section, "Username")
 	if err != nil {
 		return nil, err
 	}
 
-	var routinesSpawners []RoutineSpawner
+	config.Password, err = parseSecret(section, "Password")
+	if err != nil {
+		return nil, err
+	}
 
-	err = parseRoutinesConfig(&routinesSpawners, cfg, "TCPClientTunnel", parseTCPClientTunnelConfig)
+	config.ConnTimeouts, err = parseConnTimeouts(section)
 	if err != nil {
 		return nil, err
 	}
 
-	err = parseRoutinesConfig(&routinesSpawners, cfg, "STDIOTunnel", parseSTDIOTunnelConfig)
+	config.ConnLimits, err = parseConnLimits(section)
 	if err != nil {
 		return nil, err
 	}
 
-	err = parseRoutinesConfig(&routinesSpawners, cfg, "TCPServerTunnel", parseTCPServerTunnelConfig)
+	config.Quota, err = parseQuota(section, config.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func parseHTTPConfig(section *ini.Section) (RoutineSpawner, error) {
+	config := &HTTPConfig{}
+
+	systemdSocket, err := parseSystemdSocket(section)
+	if err != nil {
+		return nil, err
+	}
+	config.SystemdSocket = systemdSocket
+
+	if systemdSocket == "" {
+		config.BindAddress, err = parseString(section, "BindAddress")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config.SocketPermissions, err = parseSocketPermissions(section)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Username, err = parseString(section, "Username")
+	if err != nil {
+		return nil, err
+	}
+
+	config.Password, err = parseSecret(section, "Password")
+	if err != nil {
+		return nil, err
+	}
+
+	config.ConnTimeouts, err = parseConnTimeouts(section)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ConnLimits, err = parseConnLimits(section)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Quota, err = parseQuota(section, config.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func parseDestinationACL(section *ini.Section) (DestinationACL, error) {
+	var acl DestinationACL
+
+	allowedIPs, err := parseAllowedIPs(section)
+	if err != nil {
+		return acl, err
+	}
+	if len(allowedIPs) == 0 {
+		return acl, errors.New("AllowedIPs should not be empty")
+	}
+	acl.AllowedIPs = allowedIPs
+
+	ports, err := parseString(section, "AllowedPorts")
+	if err != nil {
+		return acl, err
+	}
+	for _, str := range strings.Split(ports, ",") {
+		str = strings.TrimSpace(str)
+		if len(str) == 0 {
+			continue
+		}
+		port, err := strconv.ParseUint(str, 10, 16)
+		if err != nil {
+			return acl, keyError("AllowedPorts", fmt.Errorf("invalid port %s: %w", str, err))
+		}
+		acl.AllowedPorts = append(acl.AllowedPorts, uint16(port))
+	}
+
+	return acl, nil
+}
+
+// parseReverseProxyConfig parses the keys shared by [Socks5Server] and [HTTPServer]
+func parseReverseProxyConfig(section *ini.Section) (ReverseProxyConfig, error) {
+	config := ReverseProxyConfig{}
+
+	listenPort, err := parsePort(section, "ListenPort")
+	if err != nil {
+		return config, err
+	}
+	config.ListenPort = listenPort
+
+	config.Username, err = parseString(section, "Username")
+	if err != nil {
+		return config, err
+	}
+
+	config.Password, err = parseSecret(section, "Password")
+	if err != nil {
+		return config, err
+	}
+
+	config.DestinationACL, err = parseDestinationACL(section)
+	if err != nil {
+		return config, err
+	}
+
+	config.ConnTimeouts, err = parseConnTimeouts(section)
+	if err != nil {
+		return config, err
+	}
+
+	config.ConnLimits, err = parseConnLimits(section)
+	if err != nil {
+		return config, err
+	}
+
+	config.Quota, err = parseQuota(section, config.Username)
+	if err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+func parseSocks5ServerConfig(section *ini.Section) (RoutineSpawner, error) {
+	config, err := parseReverseProxyConfig(section)
 	if err != nil {
 		return nil, err
 	}
+	return &Socks5ServerConfig{config}, nil
+}
 
-	err = parseRoutinesConfig(&routinesSpawners, cfg, "Socks5", parseSocks5Config)
+func parseHTTPServerConfig(section *ini.Section) (RoutineSpawner, error) {
+	config, err := parseReverseProxyConfig(section)
 	if err != nil {
 		return nil, err
 	}
+	return &HTTPServerConfig{config}, nil
+}
+
+func parseTransparentProxyConfig(section *ini.Section) (RoutineSpawner, error) {
+	if runtime.GOOS != "linux" {
+		return nil, errors.New("[TransparentProxy] is only supported on Linux")
+	}
 
-	err = parseRoutinesConfig(&routinesSpawners, cfg, "http", parseHTTPConfig)
+	config := &TransparentProxyConfig{}
+
+	bindAddress, err := parseString(section, "BindAddress")
 	if err != nil {
 		return nil, err
 	}
+	config.BindAddress = bindAddress
+
+	config.Mode = "redirect"
+	if mode, err := parseString(section, "Mode"); err == nil && mode != "" {
+		mode = strings.ToLower(mode)
+		if mode != "redirect" && mode != "tproxy" {
+			return nil, errors.New("Mode should be either redirect or tproxy")
+		}
+		config.Mode = mode
+	}
+
+	udp, err := parseBool(section, "UDP")
+	if err != nil {
+		return nil, err
+	}
+	config.UDP = config.Mode == "tproxy"
+	if udp != nil {
+		if *udp && config.Mode != "tproxy" {
+			return nil, errors.New("UDP requires Mode = tproxy, REDIRECT can't recover the original destination of UDP packets")
+		}
+		config.UDP = *udp
+	}
+
+	config.ConnTimeouts, err = parseConnTimeouts(section)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// oneRoutine adapts the parser of sections which always make a single routine to parseRoutinesConfig
+func oneRoutine(f func(*ini.Section) (RoutineSpawner, error)) func(*ini.Section) ([]RoutineSpawner, error) {
+	return func(section *ini.Section) ([]RoutineSpawner, error) {
+		config, err := f(section)
+		if err != nil {
+			return nil, err
+		}
+		return []RoutineSpawner{config}, nil
+	}
+}
+
+// Takes a function that parses an individual section into configs, and apply it on all
+// specified sections
+func parseRoutinesConfig(routines *[]RoutineSpawner, cfg *ini.File, sectionName string, f func(*ini.Section) ([]RoutineSpawner, error)) error {
+	sections, err := cfg.SectionsByName(sectionName)
+	if err != nil {
+		return nil
+	}
+
+	for _, section := range sections {
+		configs, err := f(section)
+		if err != nil {
+			return sectionError(section, err)
+		}
+
+		*routines = append(*routines, configs...)
+	}
+
+	return nil
+}
+
+var iniOpt = ini.LoadOptions{
+	Insensitive:            true,
+	AllowShadows:           true,
+	AllowNonUniqueSections: true,
+}
+
+// ParseConfig takes the path of a configuration file and parses it into Configuration.
+// The format of the file is detected from its extension, see FormatFromPath.
+// A relative WGConfig path is resolved from the directory of the configuration file.
+func ParseConfig(path string, options ...ParseOption) (*Configuration, error) {
+	return ParseConfigFile(path, FormatFromPath(path), options...)
+}
+
+// ParseConfigFile parses the configuration file at `path` in `format` into Configuration,
+// e.g. for files whose extension doesn't tell their format
+func ParseConfigFile(path string, format string, options ...ParseOption) (*Configuration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	source := newConfigSource(path, data, format)
+	cfg, err := loadConfig(data, format)
+	if err != nil {
+		return nil, source.locate(nil, err)
+	}
+
+	return parseConfig(cfg, source, options...)
+}
+
+// ParseConfigBytes parses the content of a configuration file into Configuration.
+// A relative WGConfig path is resolved from the working directory.
+func ParseConfigBytes(data []byte, options ...ParseOption) (*Configuration, error) {
+	source := newConfigSource("", data, FormatINI)
+	cfg, err := ini.LoadSources(iniOpt, data)
+	if err != nil {
+		return nil, source.locate(nil, err)
+	}
+
+	return parseConfig(cfg, source, options...)
+}
+
+// ParseConfigReader reads a configuration until EOF and parses it into Configuration,
+// e.g. from a pipe. A relative WGConfig path is resolved from the working directory.
+func ParseConfigReader(r io.Reader, options ...ParseOption) (*Configuration, error) {
+	return ParseConfigFormat(r, FormatINI, options...)
+}
+
+// loadWGConfig loads the wireguard configuration file referenced by WGConfig, and returns `cfg` if
+// there is none. A relative path is resolved from the directory of the configuration file.
+func loadWGConfig(cfg *ini.File, source *configSource) (*ini.File, *configSource, error) {
+	root := cfg.Section("")
+	wgConf, err := root.GetKey("WGConfig")
+	if err != nil {
+		return cfg, source, nil
+	}
+
+	wgPath := wgConf.String()
+	if source.path != "" && !filepath.IsAbs(wgPath) {
+		wgPath = filepath.Join(filepath.Dir(source.path), wgPath)
+	}
+	data, err := os.ReadFile(wgPath)
+	if err != nil {
+		return nil, nil, sectionError(root, keyError("WGConfig", err))
+	}
+
+	wgSource := newConfigSource(wgPath, data, FormatINI)
+	wgCfg, err := ini.LoadSources(iniOpt, data)
+	if err != nil {
+		return nil, nil, wgSource.locate(nil, err)
+	}
+	return wgCfg, wgSource, nil
+}
+
+// parseConfig parses a loaded configuration file, and locates its errors in `source`
+func parseConfig(cfg *ini.File, source *configSource, options ...ParseOption) (*Configuration, error) {
+	var opts parseOptions
+	for _, option := range options {
+		option(&opts)
+	}
+
+	wgCfg, wgSource, err := loadWGConfig(cfg, source)
+	if err != nil {
+		return nil, source.locate(cfg, err)
+	}
+
+	if err := runCommands(cfg, opts.commands); err != nil {
+		return nil, source.locate(cfg, err)
+	}
+	if wgCfg != cfg {
+		if err := runCommands(wgCfg, opts.commands); err != nil {
+			return nil, wgSource.locate(wgCfg, err)
+		}
+	}
+
+	return parseConfigFiles(cfg, source, wgCfg, wgSource)
+}
+
+// parseConfigFiles parses a loaded configuration file and the wireguard configuration file it
+// references, which is `cfg` itself when there is none
+func parseConfigFiles(cfg *ini.File, source *configSource, wgCfg *ini.File, wgSource *configSource) (*Configuration, error) {
+	device := &DeviceConfig{
+		MTU: 1420,
+	}
+
+	err := ParseInterface(wgCfg, device)
+	if err != nil {
+		return nil, wgSource.locate(wgCfg, singleSectionError(wgCfg, "Interface", err))
+	}
+
+	err = ParsePeers(wgCfg, &device.Peers)
+	if err != nil {
+		return nil, wgSource.locate(wgCfg, err)
+	}
+
+	for _, section := range []struct {
+		name  string
+		parse func(*ini.File, *DeviceConfig) error
+	}{
+		{"TUN", ParseTUN},
+		{"Capture", ParseCapture},
+		{"Netstack", ParseNetstack},
+		{"Accounting", ParseAccounting},
+		{"UAPI", ParseUAPI},
+	} {
+		if err := section.parse(cfg, device); err != nil {
+			return nil, source.locate(cfg, singleSectionError(cfg, section.name, err))
+		}
+	}
+
+	var routinesSpawners []RoutineSpawner
+
+	err = parseRoutinesConfig(&routinesSpawners, cfg, "TCPClientTunnel", parseTCPClientTunnelConfig)
+	if err != nil {
+		return nil, source.locate(cfg, err)
+	}
+
+	err = parseRoutinesConfig(&routinesSpawners, cfg, "STDIOTunnel", oneRoutine(parseSTDIOTunnelConfig))
+	if err != nil {
+		return nil, source.locate(cfg, err)
+	}
+
+	err = parseRoutinesConfig(&routinesSpawners, cfg, "TCPServerTunnel", parseTCPServerTunnelConfig)
+	if err != nil {
+		return nil, source.locate(cfg, err)
+	}
+
+	err = parseRoutinesConfig(&routinesSpawners, cfg, "Socks5", oneRoutine(parseSocks5Config))
+	if err != nil {
+		return nil, source.locate(cfg, err)
+	}
+
+	err = parseRoutinesConfig(&routinesSpawners, cfg, "http", oneRoutine(parseHTTPConfig))
+	if err != nil {
+		return nil, source.locate(cfg, err)
+	}
+
+	err = parseRoutinesConfig(&routinesSpawners, cfg, "Socks5Server", oneRoutine(parseSocks5ServerConfig))
+	if err != nil {
+		return nil, source.locate(cfg, err)
+	}
+
+	err = parseRoutinesConfig(&routinesSpawners, cfg, "HTTPServer", oneRoutine(parseHTTPServerConfig))
+	if err != nil {
+		return nil, source.locate(cfg, err)
+	}
+
+	err = parseRoutinesConfig(&routinesSpawners, cfg, "TransparentProxy", oneRoutine(parseTransparentProxyConfig))
+	if err != nil {
+		return nil, source.locate(cfg, err)
+	}
 
 	return &Configuration{
 		Device:   device,
 		Routines: routinesSpawners,
 	}, nil
 }
+
+// ConfigNeeds tells what a configuration needs from the process while it is parsed and
+// once it runs, without parsing it, so that the process can be sandboxed beforehand
+type ConfigNeeds struct {
+	// Exec is set when a key references the output of a command
+	Exec bool
+	// Write is set when files, devices or unix sockets may be created
+	Write bool
+	// UnixSockets is set when unix sockets may be listened on
+	UnixSockets bool
+}
+
+// ScanConfig finds the needs of the configuration `data` in `format` read from `path`,
+// which is empty for standard input. It errs on the side of needing more.
+func ScanConfig(path string, data []byte, format string) (*ConfigNeeds, error) {
+	source := newConfigSource(path, data, format)
+	cfg, err := loadConfig(data, format)
+	if err != nil {
+		return nil, source.locate(nil, err)
+	}
+	wgCfg, _, err := loadWGConfig(cfg, source)
+	if err != nil {
+		return nil, source.locate(cfg, err)
+	}
+
+	needs := &ConfigNeeds{}
+	for _, file := range []*ini.File{cfg, wgCfg} {
+		for _, section := range file.Sections() {
+			for _, key := range section.Keys() {
+				needs.Exec = needs.Exec || strings.HasPrefix(strings.TrimSpace(key.String()), "exec:")
+			}
+		}
+	}
+	for _, section := range cfg.Sections() {
+		value := strings.TrimSpace(section.Key("BindAddress").String())
+		// a reference may resolve to a unix: address
+		if strings.HasPrefix(value, "unix:") || isReference(value) {
+			needs.UnixSockets = true
+		}
+	}
+
+	needs.UnixSockets = needs.UnixSockets || cfg.HasSection("UAPI")
+	needs.Write = needs.UnixSockets || cfg.HasSection("Capture") || cfg.HasSection("Accounting") || cfg.HasSection("TUN")
+	return needs, nil
+}
@@ -1,8 +1,18 @@
 package wireproxy
 
 import (
-	"github.com/go-ini/ini"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
+
+	"github.com/go-ini/ini"
 )
 
 func loadIniConfig(config string) (*ini.File, error) {
@@ -85,3 +95,827 @@ Endpoint = 192.200.144.22:51820`
 		t.Fatal(err)
 	}
 }
+
+func TestTransparentProxyMode(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("transparent proxy is only supported on Linux")
+	}
+
+	const config = `
+[TransparentProxy]
+BindAddress = 127.0.0.1:12345
+Mode = TPROXY
+
+[TransparentProxy]
+BindAddress = 127.0.0.1:12346
+Mode = dnat
+
+[TransparentProxy]
+BindAddress = 127.0.0.1:12347
+UDP = true`
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sections, err := iniData.SectionsByName("TransparentProxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spawner, err := parseTransparentProxyConfig(sections[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config := spawner.(*TransparentProxyConfig); config.Mode != "tproxy" || !config.UDP {
+		t.Fatalf("expected tproxy with UDP, got %+v", config)
+	}
+
+	if _, err := parseTransparentProxyConfig(sections[1]); err == nil {
+		t.Fatal("expected invalid mode to be rejected")
+	}
+	if _, err := parseTransparentProxyConfig(sections[2]); err == nil {
+		t.Fatal("expected UDP to be rejected with redirect")
+	}
+}
+
+func TestTUNConfig(t *testing.T) {
+	const config = `
+[TUN]
+FD = 3
+Address = 10.5.0.3/32`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ParseTUN(iniData, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TUN == nil || *cfg.TUN.FD != 3 || len(cfg.TUN.Address) != 1 {
+		t.Fatalf("unexpected TUN config: %+v", cfg.TUN)
+	}
+}
+
+func TestCaptureConfig(t *testing.T) {
+	const config = `
+[Capture]
+File = /tmp/capture.pcap
+Host = 10.5.0.1
+Port = 53, 443
+MaxSize = 1048576`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ParseCapture(iniData, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Capture.Filter.Hosts) != 1 || len(cfg.Capture.Filter.Ports) != 2 || cfg.Capture.MaxSize != 1048576 {
+		t.Fatalf("unexpected capture config: %+v", cfg.Capture)
+	}
+}
+
+func TestWireguardConfWithAutoMTU(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+MTU = auto
+MSSClamp = 1300
+CheckAlive = 10.5.0.1`
+	cfg := DeviceConfig{MTU: 1420}
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ParseInterface(iniData, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.MTUDiscovery || cfg.MTU != 1420 || cfg.MSSClamp != 1300 {
+		t.Fatalf("unexpected MTU config: %+v", cfg)
+	}
+}
+
+func TestNetstackConfig(t *testing.T) {
+	const config = `
+[Netstack]
+CongestionControl = Cubic
+SACK = false
+ReceiveBufferMax = 8388608
+KeepAlive = 60
+ForwardBufferSize = 262144`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ParseNetstack(iniData, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	netstack := cfg.Netstack
+	if netstack.CongestionControl != "cubic" || netstack.SACK == nil || *netstack.SACK ||
+		netstack.ReceiveBufferMax != 8388608 || netstack.KeepAlive != 60 || netstack.KeepAliveInterval != 75 ||
+		netstack.ForwardBufferSize != 262144 {
+		t.Fatalf("unexpected netstack config: %+v", netstack)
+	}
+}
+
+func TestConnTimeouts(t *testing.T) {
+	const config = `
+[Socks5]
+BindAddress = 127.0.0.1:25344
+IdleTimeout = 300
+MaxLifetime = 3600
+
+[Socks5]
+BindAddress = 127.0.0.1:25345
+IdleTimeout = -1`
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sections, err := iniData.SectionsByName("Socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spawner, err := parseSocks5Config(sections[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeouts := spawner.(*Socks5Config).ConnTimeouts
+	if timeouts.IdleTimeout != 300 || timeouts.MaxLifetime != 3600 {
+		t.Fatalf("unexpected timeouts %+v", timeouts)
+	}
+
+	if _, err := parseSocks5Config(sections[1]); err == nil {
+		t.Fatal("expected negative IdleTimeout to be rejected")
+	}
+}
+
+func TestConnLimits(t *testing.T) {
+	const config = `
+[http]
+BindAddress = 127.0.0.1:25345
+MaxConnections = 100
+MaxConnectionsPerIP = 10
+ConnectionRate = 0.5
+Bandwidth = 1000000
+
+[http]
+BindAddress = 127.0.0.1:25346
+ConnectionRate = fast`
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sections, err := iniData.SectionsByName("http")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spawner, err := parseHTTPConfig(sections[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ConnLimits{MaxConnections: 100, MaxConnectionsPerIP: 10, ConnectionRate: 0.5, Bandwidth: 1000000}
+	if limits := spawner.(*HTTPConfig).ConnLimits; limits != expected {
+		t.Fatalf("unexpected limits %+v", limits)
+	}
+
+	if _, err := parseHTTPConfig(sections[1]); err == nil {
+		t.Fatal("expected invalid ConnectionRate to be rejected")
+	}
+}
+
+func TestQuotaConfig(t *testing.T) {
+	const config = `
+[Accounting]
+StateFile = /var/lib/wireproxy/usage.json
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+Username = alice
+Password = secret
+DailyQuota = 1000
+
+[Socks5]
+BindAddress = 127.0.0.1:25345
+MonthlyQuota = 1000`
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device := &DeviceConfig{}
+	if err := ParseAccounting(iniData, device); err != nil {
+		t.Fatal(err)
+	}
+	if device.Accounting == nil || device.Accounting.StateFile != "/var/lib/wireproxy/usage.json" {
+		t.Fatalf("unexpected accounting %+v", device.Accounting)
+	}
+
+	sections, err := iniData.SectionsByName("Socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spawner, err := parseSocks5Config(sections[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota := spawner.(*Socks5Config).Quota; quota.DailyQuota != 1000 || quota.MonthlyQuota != 0 {
+		t.Fatalf("unexpected quota %+v", quota)
+	}
+
+	if _, err := parseSocks5Config(sections[1]); err == nil {
+		t.Fatal("expected quota without Username to be rejected")
+	}
+}
+
+func TestWGConfigRelativePath(t *testing.T) {
+	dir := t.TempDir()
+	const wgConfig = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820`
+	if err := os.WriteFile(filepath.Join(dir, "wg0.conf"), []byte(wgConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	const config = `
+WGConfig = wg0.conf
+
+[Socks5]
+BindAddress = 127.0.0.1:25344`
+	path := filepath.Join(dir, "wireproxy.conf")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := ParseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Device.Peers) != 1 || len(conf.Routines) != 1 {
+		t.Fatalf("unexpected configuration %+v", conf)
+	}
+
+	conf, err = ParseConfigReader(strings.NewReader(strings.Replace(config, "wg0.conf", filepath.Join(dir, "wg0.conf"), 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Device.Peers) != 1 {
+		t.Fatalf("unexpected configuration %+v", conf)
+	}
+}
+
+func TestSecretReferences(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "private.key"), []byte("LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "password"), []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SECRETS_DIRECTORY", dir)
+
+	config := `
+[Interface]
+PrivateKeyFile = ` + filepath.Join(dir, "private.key") + `
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+PresharedKey = exec:echo UItQuvLsyh50ucXHfjF0bbR4IIpVBd74lwKc8uIPXXs=
+Endpoint = 94.140.11.15:51820
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+Username = alice
+Password = file:$SECRETS_DIRECTORY/password`
+
+	_, err := ParseConfigBytes([]byte(config))
+	if err == nil || !strings.Contains(err.Error(), "running commands is not enabled") {
+		t.Errorf("expected exec: to be rejected without WithCommands, got %v", err)
+	}
+
+	conf, err := ParseConfigBytes([]byte(config), WithCommands())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Device.SecretKey != "2c0af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b3d" {
+		t.Errorf("unexpected SecretKey %s", conf.Device.SecretKey)
+	}
+	if conf.Device.Peers[0].PreSharedKey != "508b50baf2ecca1e74b9c5c77e31746db478208a5505def897029cf2e20f5d7b" {
+		t.Errorf("unexpected PreSharedKey %s", conf.Device.Peers[0].PreSharedKey)
+	}
+	if password := conf.Routines[0].(*Socks5Config).Password; password != "hunter2" {
+		t.Errorf("unexpected Password %s", password)
+	}
+
+	// a leading backslash escapes a reference, and the output of commands is taken literally
+	literal := strings.Replace(config, "Password = file:$SECRETS_DIRECTORY/password", `Password = \file:password`, 1)
+	literal = strings.Replace(literal, "Username = alice", "Username = exec:echo '$HOME'", 1)
+	conf, err = ParseConfigBytes([]byte(literal), WithCommands())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if socks5 := conf.Routines[0].(*Socks5Config); socks5.Password != "file:password" || socks5.Username != "$HOME" {
+		t.Errorf("unexpected credentials %s:%s", socks5.Username, socks5.Password)
+	}
+
+	_, err = ParseConfigBytes([]byte(strings.Replace(config, "Address = 10.5.0.2", "Address = 10.5.0.2\nPrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=", 1)))
+	if err == nil {
+		t.Error("PrivateKey and PrivateKeyFile should be mutually exclusive")
+	}
+
+	needs, err := ScanConfig("", []byte(config), FormatINI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !needs.Exec || needs.Write || needs.UnixSockets {
+		t.Errorf("unexpected needs %+v", needs)
+	}
+	needs, err = ScanConfig("", []byte(strings.ReplaceAll(config, "exec:", "")), FormatINI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if needs.Exec {
+		t.Error("configuration without exec: should not need exec")
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	configs := map[string]string{
+		FormatJSON: `{
+  "Interface": {"PrivateKey": "LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=", "Address": ["10.5.0.2", "fd00::2"], "MTU": 1400},
+  "Peer": [{"PublicKey": "e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=", "Endpoint": "94.140.11.15:51820"}],
+  "Socks5": [{"BindAddress": "127.0.0.1:25344"}, {"BindAddress": "127.0.0.1:25345"}]
+}`,
+		FormatYAML: `
+Interface:
+  PrivateKey: LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+  Address: [10.5.0.2, fd00::2]
+  MTU: 1400
+Peer:
+  PublicKey: e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+  Endpoint: 94.140.11.15:51820
+Socks5:
+  - BindAddress: 127.0.0.1:25344
+  - BindAddress: 127.0.0.1:25345
+`,
+		FormatTOML: `
+[Interface]
+PrivateKey = "LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0="
+Address = ["10.5.0.2", "fd00::2"]
+MTU = 1400
+
+[[Peer]]
+PublicKey = "e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w="
+Endpoint = "94.140.11.15:51820"
+
+[[Socks5]]
+BindAddress = "127.0.0.1:25344"
+
+[[Socks5]]
+BindAddress = "127.0.0.1:25345"
+`,
+	}
+
+	for format, config := range configs {
+		conf, err := ParseConfigFormat(strings.NewReader(config), format)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if len(conf.Device.Endpoint) != 2 || conf.Device.MTU != 1400 {
+			t.Errorf("%s: unexpected interface %+v", format, conf.Device)
+		}
+		if len(conf.Device.Peers) != 1 || *conf.Device.Peers[0].Endpoint != "94.140.11.15:51820" {
+			t.Errorf("%s: unexpected peers %+v", format, conf.Device.Peers)
+		}
+		if len(conf.Routines) != 2 {
+			t.Errorf("%s: expected 2 routines, got %d", format, len(conf.Routines))
+		}
+	}
+	nested := `
+Interface:
+  PrivateKey: LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+  Address: 10.5.0.2
+Peer:
+  PublicKey: e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+  Endpoint: 94.140.11.15:51820
+Socks5Server:
+  ListenPort: 1080
+  DestinationACL:
+    AllowedIPs: [192.168.1.0/24]
+    AllowedPorts: [22, 443]
+TCPServerTunnel:
+  ListenPort: 8080
+  LoadBalancing:
+    Target: [192.168.1.10:80, 192.168.1.11:80]
+    Balance: failover
+`
+	conf, err := ParseConfigFormat(strings.NewReader(nested), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, routine := range conf.Routines {
+		switch routine := routine.(type) {
+		case *Socks5ServerConfig:
+			if len(routine.AllowedIPs) != 1 || !slices.Equal(routine.AllowedPorts, []uint16{22, 443}) {
+				t.Errorf("unexpected ACL %+v", routine.DestinationACL)
+			}
+		case *TCPServerTunnelConfig:
+			if len(routine.Targets) != 2 || routine.Balance != BalanceFailover {
+				t.Errorf("unexpected load balancing %+v", routine.LoadBalancing)
+			}
+		}
+	}
+
+	for _, invalid := range []struct {
+		old, new, want string
+	}{
+		{"DestinationACL:", "ACL:", "ACL is not a group of keys"},
+		{"Balance:", "Mode:", "LoadBalancing has no key Mode"},
+	} {
+		want := invalid.want
+		_, err := ParseConfigFormat(strings.NewReader(strings.Replace(nested, invalid.old, invalid.new, 1)), FormatYAML)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got %v", want, err)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+CheckAlive = 10.9.0.1
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+AllowedIPs = 10.0.0.0/8
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.16:51820
+AllowedIPs = 10.1.0.0/16
+
+[Sock5]
+BindAddress = 127.0.0.1:25344
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+Pasword = hunter2
+
+[http]
+BindAddress = :25344`
+
+	problems := CheckConfigFormat(strings.NewReader(config), FormatINI)
+	expected := []struct {
+		line int
+		key  string
+	}{
+		{17, ""},
+		{22, "pasword"},
+		{25, "BindAddress"},
+		{15, "AllowedIPs"},
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if problem.Line != expected[i].line || problem.Key != expected[i].key {
+			t.Errorf("unexpected problem %+v", problem)
+		}
+	}
+
+	_, err := ParseConfigBytes([]byte(strings.Replace(config, "CheckAlive = 10.9.0.1", "CheckAlive = 10.9.0", 1)))
+	if err == nil || err.Error() != `line 5: [Interface] CheckAlive: ParseAddr("10.9.0"): IPv4 address too short` {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	ran := filepath.Join(t.TempDir(), "ran")
+	problems = CheckConfigFormat(strings.NewReader(`
+[Interface]
+PrivateKey = exec:touch `+ran+`
+Address = 10.5.0.2
+
+[Peer]
+PublicKeyFile = `+filepath.Join(t.TempDir(), "missing")+`
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=`), FormatINI)
+	if _, err := os.Stat(ran); err == nil {
+		t.Error("checking a configuration should not run commands")
+	}
+	if len(problems) != 1 || problems[0].Key != "PublicKeyFile" || strings.Contains(problems[0].Message, "unknown key") {
+		t.Errorf("unexpected problems %v", problems)
+	}
+
+	// a peer without AllowedIPs routes every address
+	problems = CheckConfigFormat(strings.NewReader(`
+[Interface]
+PrivateKeyFile = exec:touch `+ran+`
+Address = 10.5.0.2
+CheckAlive = 1.1.1.1
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+Username = alice
+PasswordFile = exec:touch `+ran), FormatINI)
+	if len(problems) != 0 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Error("checking a configuration should not run commands")
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+
+[http]
+BindAddress = 127.0.0.1:25345
+Username = alice
+Password = hunter2`
+
+	conf, err := ParseConfigBytes([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{FormatINI, FormatJSON} {
+		dump, err := DumpConfig(conf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(dump), "hunter2") || strings.Contains(string(dump), "LAr1aNSNF9d0MjwUgAVC4020T0N") {
+			t.Errorf("%s: secrets are not redacted:\n%s", format, dump)
+		}
+
+		// the dump parses into the same configuration once the secrets are filled in
+		dump = []byte(strings.Replace(string(dump), redacted, "LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=", 1))
+		parsed, err := ParseConfigFormat(strings.NewReader(string(dump)), format)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if parsed.Device.MTU != 1420 || len(parsed.Device.Peers[0].AllowedIPs) != 2 || len(parsed.Routines) != 1 {
+			t.Errorf("%s: unexpected configuration %+v", format, parsed.Device)
+		}
+	}
+}
+
+func TestSystemdSocket(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+
+[TCPClientTunnel]
+SystemdSocket = tunnel
+Target = example.com:22`
+
+	conf, err := ParseConfigBytes([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := conf.Routines[0].(*TCPClientTunnelConfig)
+	if tunnel.SystemdSocket != "tunnel" || tunnel.BindAddress != nil {
+		t.Errorf("unexpected configuration %+v", tunnel)
+	}
+
+	_, err = ParseConfigBytes([]byte(config + "\nBindAddress = 127.0.0.1:2222"))
+	if err == nil || !strings.Contains(err.Error(), "only one of BindAddress and SystemdSocket") {
+		t.Errorf("expected a conflict between BindAddress and SystemdSocket, got %v", err)
+	}
+}
+
+func TestUnixSocketListeners(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+
+[TCPClientTunnel]
+BindAddress = unix:/run/wireproxy/tunnel.sock
+Target = example.com:22
+SocketMode = 0660
+
+[Socks5]
+BindAddress = unix:/run/wireproxy/tunnel.sock`
+
+	conf, err := ParseConfigBytes([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := conf.Routines[0].(*TCPClientTunnelConfig)
+	if tunnel.UnixSocket != "/run/wireproxy/tunnel.sock" || tunnel.BindAddress != nil || tunnel.SocketMode != 0660 {
+		t.Errorf("unexpected configuration %+v", tunnel)
+	}
+
+	problems := CheckConfigFormat(strings.NewReader(config), FormatINI)
+	if len(problems) != 1 || problems[0].Line != 16 || problems[0].Key != "BindAddress" {
+		t.Errorf("expected a conflict between the unix sockets, got %v", problems)
+	}
+}
+
+func TestReverseProxyACL(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+
+[Socks5Server]
+ListenPort = 1080
+AllowedIPs = 192.168.1.0/24, fd00::/64
+AllowedPorts = 22, 443`
+
+	conf, err := ParseConfigBytes([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl := conf.Routines[0].(*Socks5ServerConfig).DestinationACL
+	for addr, allowed := range map[string]bool{
+		"192.168.1.10:22":           true,
+		"[::ffff:192.168.1.10]:443": true,
+		"[fd00::1]:22":              true,
+		"192.168.1.10:80":           false,
+		"192.168.2.10:22":           false,
+		"127.0.0.1:22":              false,
+	} {
+		if acl.allows(netip.MustParseAddrPort(addr)) != allowed {
+			t.Errorf("expected %s to be allowed: %v", addr, allowed)
+		}
+	}
+
+	_, err = ParseConfigBytes([]byte(strings.Replace(config, "AllowedIPs = 192.168.1.0/24, fd00::/64", "", 1)))
+	if err == nil || !strings.Contains(err.Error(), "AllowedIPs should not be empty") {
+		t.Errorf("expected AllowedIPs to be required, got %v", err)
+	}
+}
+
+func TestPortRanges(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+
+[TCPClientTunnel]
+BindAddress = 127.0.0.1:8000-8002
+Target = example.com:9000-9002
+
+[TCPServerTunnel]
+ListenPort = 80, 8080-8081
+Target = localhost:80`
+
+	conf, err := ParseConfigBytes([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Routines) != 6 {
+		t.Fatalf("expected 6 tunnels, got %d", len(conf.Routines))
+	}
+	client := conf.Routines[2].(*TCPClientTunnelConfig)
+	if client.BindAddress.String() != "127.0.0.1:8002" || client.Target != "example.com:9002" {
+		t.Errorf("unexpected tunnel %+v", client)
+	}
+	server := conf.Routines[4].(*TCPServerTunnelConfig)
+	if server.ListenPort != 8080 || server.Target != "localhost:80" {
+		t.Errorf("unexpected tunnel %+v", server)
+	}
+	if server.group == nil || server.group != conf.Routines[3].(*TCPServerTunnelConfig).group {
+		t.Error("expected the tunnels of a section to be grouped")
+	}
+
+	_, err = ParseConfigBytes([]byte(strings.Replace(config, "example.com:9000-9002", "example.com:9000-9001", 1)))
+	if err == nil || !strings.Contains(err.Error(), "2 target ports given for 3 listening ports") {
+		t.Errorf("expected mismatching port ranges to fail, got %v", err)
+	}
+
+	for listenPort, want := range map[string]string{
+		"80, 80":           "port 80 is given more than once",
+		"8000-8010, 8005":  "port 8005 is given more than once",
+		"1-65535":          "too many ports",
+		"$WIREPROXY_UNSET": "unset environment variable",
+	} {
+		_, err = ParseConfigBytes([]byte(strings.Replace(config, "ListenPort = 80, 8080-8081", "ListenPort = "+listenPort, 1)))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected ListenPort = %s to fail with %q, got %v", listenPort, want, err)
+		}
+	}
+
+	problems := CheckConfigFormat(strings.NewReader(config+"\n\n[TCPServerTunnel]\nListenPort = 8081\nTarget = localhost:22"), FormatINI)
+	if len(problems) != 1 || problems[0].Key != "ListenPort" {
+		t.Errorf("expected a conflict between the listening ports, got %v", problems)
+	}
+}
+
+func TestLoadBalancing(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+
+[TCPServerTunnel]
+ListenPort = 8000-8001
+Target = 192.168.1.10:9000-9001, 192.168.1.11:9000, 9001
+Balance = failover
+HealthCheckInterval = 10`
+
+	conf, err := ParseConfigBytes([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := conf.Routines[1].(*TCPServerTunnelConfig)
+	expected := []string{"192.168.1.10:9001", "192.168.1.11:9001"}
+	if tunnel.Target != "" || !slices.Equal(tunnel.Targets, expected) || tunnel.Balance != BalanceFailover || tunnel.HealthCheckInterval != 10 {
+		t.Errorf("unexpected tunnel %+v", tunnel)
+	}
+
+	targets, err := newBalancer("", LoadBalancing{Targets: []string{"a:1", "b:1", "c:1"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets.backends[1].healthy.Store(false)
+	for _, first := range []string{"a:1", "c:1", "a:1"} {
+		if order := targets.order(); order[0].target != first || order[2].target != "b:1" {
+			t.Errorf("expected %s first and the unhealthy target last, got %s, %s, %s", first, order[0].target, order[1].target, order[2].target)
+		}
+	}
+
+	targets.backends[1].healthy.Store(true)
+	targets.dial = func(ctx context.Context, address *addressPort) (net.Conn, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("expected the connection to a target to have a deadline")
+		}
+		if address.address != "c" {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	}
+	conn, release, err := targets.connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	_ = conn.Close()
+	if targets.backends[0].healthy.Load() || targets.backends[1].healthy.Load() || !targets.backends[2].healthy.Load() {
+		t.Error("expected the targets which refused the connection to be unhealthy")
+	}
+
+	_, err = ParseConfigBytes([]byte(strings.Replace(config, "failover", "fastest", 1)))
+	if err == nil || !strings.Contains(err.Error(), "Balance should be") {
+		t.Errorf("expected an invalid Balance to fail, got %v", err)
+	}
+}
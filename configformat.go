@@ -0,0 +1,251 @@
+package wireproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-ini/ini"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of configuration files
+const (
+	FormatINI  = "ini"
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// FormatFromPath detects the format of a configuration file from its extension,
+// files without a known extension are in the INI format
+func FormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatINI
+	}
+}
+
+// ParseConfigFormat reads a configuration in `format` until EOF and parses it into Configuration.
+// A relative WGConfig path is resolved from the working directory.
+func ParseConfigFormat(r io.Reader, format string, options ...ParseOption) (*Configuration, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	source := newConfigSource("", data, format)
+	cfg, err := loadConfig(data, format)
+	if err != nil {
+		return nil, source.locate(nil, err)
+	}
+
+	return parseConfig(cfg, source, options...)
+}
+
+// loadConfig loads the content of a configuration file in `format`
+func loadConfig(data []byte, format string) (*ini.File, error) {
+	var document map[string]interface{}
+	switch format {
+	case FormatINI:
+		return ini.LoadSources(iniOpt, data)
+	case FormatJSON:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			return nil, errors.New("invalid JSON configuration: " + err.Error())
+		}
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, errors.New("invalid YAML configuration: " + err.Error())
+		}
+	case FormatTOML:
+		if err := toml.Unmarshal(data, &document); err != nil {
+			return nil, errors.New("invalid TOML configuration: " + err.Error())
+		}
+	default:
+		return nil, errors.New("unknown configuration format " + format)
+	}
+
+	return documentToINI(document)
+}
+
+// keyGroups are the settings shared by several sections, which are structures of their own in
+// the configuration types, e.g. the DestinationACL of a Socks5ServerConfig. Structured formats
+// may nest their keys in an object named after the group.
+var keyGroups = map[string][]string{
+	"DestinationACL": {"AllowedIPs", "AllowedPorts"},
+	"LoadBalancing":  concatKeys([]string{"Target"}, loadBalancingKeys),
+	"ConnTimeouts":   connTimeoutsKeys,
+	"ConnLimits":     connLimitsKeys,
+	"Quota":          quotaKeys,
+}
+
+// documentToINI maps a structured configuration onto the sections of the INI format, so that
+// it is parsed into the same types. Top level values are keys outside of any section, objects
+// are sections, and lists of objects are repeated sections, such as several [Peer]. Lists of
+// values are joined with commas, such as the AllowedIPs of a peer. Objects inside a section
+// are groups of keys, see keyGroups.
+func documentToINI(document map[string]interface{}) (*ini.File, error) {
+	cfg := ini.Empty(iniOpt)
+	root := cfg.Section("")
+
+	for _, name := range sortedKeys(document) {
+		switch value := document[name].(type) {
+		case map[string]interface{}:
+			if err := addSection(cfg, name, value); err != nil {
+				return nil, err
+			}
+		case []map[string]interface{}:
+			// arrays of tables in TOML
+			for _, element := range value {
+				if err := addSection(cfg, name, element); err != nil {
+					return nil, err
+				}
+			}
+		case []interface{}:
+			if !isSectionList(value) {
+				if err := addKey(root, name, value); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			for _, element := range value {
+				if err := addSection(cfg, name, element.(map[string]interface{})); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			if err := addKey(root, name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// isSectionList checks whether a list holds sections rather than values
+func isSectionList(list []interface{}) bool {
+	for _, element := range list {
+		if _, ok := element.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return len(list) > 0
+}
+
+func addSection(cfg *ini.File, name string, keys map[string]interface{}) error {
+	section, err := cfg.NewSection(name)
+	if err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(keys) {
+		var err error
+		if group, ok := keys[key].(map[string]interface{}); ok {
+			err = addGroup(section, key, group)
+		} else {
+			err = addKey(section, key, keys[key])
+		}
+		if err != nil {
+			return errors.New("[" + name + "]: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// addGroup adds the keys of the group `name` to `section`
+func addGroup(section *ini.Section, name string, keys map[string]interface{}) error {
+	var groupKeys []string
+	for group, known := range keyGroups {
+		if strings.EqualFold(group, name) {
+			groupKeys = known
+		}
+	}
+	if groupKeys == nil {
+		groups := make([]string, 0, len(keyGroups))
+		for group := range keyGroups {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		return fmt.Errorf("%s is not a group of keys, which are %s", name, strings.Join(groups, ", "))
+	}
+
+	for _, key := range sortedKeys(keys) {
+		if !slices.ContainsFunc(groupKeys, func(known string) bool { return strings.EqualFold(known, key) }) {
+			return fmt.Errorf("%s has no key %s", name, key)
+		}
+		if err := addKey(section, key, keys[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addKey(section *ini.Section, name string, value interface{}) error {
+	var str string
+	if list, ok := value.([]interface{}); ok {
+		values := make([]string, 0, len(list))
+		for _, element := range list {
+			elementStr, err := formatValue(name, element)
+			if err != nil {
+				return err
+			}
+			values = append(values, elementStr)
+		}
+		str = strings.Join(values, ", ")
+	} else {
+		var err error
+		str, err = formatValue(name, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := section.NewKey(name, str)
+	return err
+}
+
+// formatValue formats a value as it would be written in an INI file
+func formatValue(name string, value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int:
+		return strconv.Itoa(value), nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case uint64:
+		return strconv.FormatUint(value, 10), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case json.Number:
+		return value.String(), nil
+	default:
+		return "", fmt.Errorf("%s has an unsupported value of type %T", name, value)
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
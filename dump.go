@@ -0,0 +1,362 @@
+package wireproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// redacted replaces secrets in dumped configurations
+const redacted = "REDACTED"
+
+// zeroKey is the preshared key of peers without one
+const zeroKey = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// singleSections are the sections which appear at most once, the others are dumped as lists in JSON
+var singleSections = []string{"Interface", "TUN", "Capture", "Netstack", "Accounting", "UAPI"}
+
+// DumpConfig renders the effective configuration `conf` in `format`, either FormatINI or FormatJSON:
+// WGConfig is inlined, defaults are filled in and secrets are redacted
+func DumpConfig(conf *Configuration, format string) ([]byte, error) {
+	cfg := configToINI(conf)
+
+	switch format {
+	case FormatINI:
+		var b bytes.Buffer
+		if _, err := cfg.WriteTo(&b); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case FormatJSON:
+		data, err := json.MarshalIndent(iniToDocument(cfg), "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	default:
+		return nil, errors.New("unsupported dump format " + format)
+	}
+}
+
+// configToINI maps a configuration back onto the sections of the INI format
+func configToINI(conf *Configuration) *ini.File {
+	cfg := ini.Empty(ini.LoadOptions{AllowNonUniqueSections: true})
+
+	device := conf.Device
+	section := newDumpSection(cfg, "Interface")
+	setKey(section, "Address", joinAddrs(device.Endpoint))
+	setKey(section, "PrivateKey", redacted)
+	setKey(section, "DNS", joinAddrs(device.DNS))
+	if device.MTUDiscovery {
+		setKey(section, "MTU", "auto")
+	} else {
+		setKey(section, "MTU", strconv.Itoa(device.MTU))
+	}
+	if device.MSSClamp > 0 {
+		setKey(section, "MSSClamp", strconv.Itoa(device.MSSClamp))
+	}
+	if device.ListenPort != nil {
+		setKey(section, "ListenPort", strconv.Itoa(*device.ListenPort))
+	}
+	if len(device.CheckAlive) > 0 {
+		setKey(section, "CheckAlive", joinAddrs(device.CheckAlive))
+		setKey(section, "CheckAliveInterval", strconv.Itoa(device.CheckAliveInterval))
+	}
+
+	for _, peer := range device.Peers {
+		section := newDumpSection(cfg, "Peer")
+		setKey(section, "PublicKey", hexToBase64(peer.PublicKey))
+		if peer.PreSharedKey != "" && peer.PreSharedKey != zeroKey {
+			setKey(section, "PreSharedKey", redacted)
+		}
+		if peer.Endpoint != nil {
+			setKey(section, "Endpoint", *peer.Endpoint)
+		}
+		if peer.KeepAlive > 0 {
+			setKey(section, "PersistentKeepalive", strconv.Itoa(peer.KeepAlive))
+		}
+		allowedIPs := peer.routedIPs()
+		prefixes := make([]string, 0, len(allowedIPs))
+		for _, prefix := range allowedIPs {
+			prefixes = append(prefixes, prefix.String())
+		}
+		setKey(section, "AllowedIPs", strings.Join(prefixes, ", "))
+	}
+
+	if tun := device.TUN; tun != nil {
+		section := newDumpSection(cfg, "TUN")
+		setKey(section, "Name", tun.Name)
+		if tun.FD != nil {
+			setKey(section, "FD", strconv.Itoa(*tun.FD))
+		}
+		setKey(section, "Address", joinAddrs(tun.Address))
+	}
+
+	if capture := device.Capture; capture != nil {
+		section := newDumpSection(cfg, "Capture")
+		setKey(section, "File", capture.File)
+		setKey(section, "Host", joinAddrs(capture.Filter.Hosts))
+		ports := make([]string, 0, len(capture.Filter.Ports))
+		for _, port := range capture.Filter.Ports {
+			ports = append(ports, strconv.Itoa(int(port)))
+		}
+		setKey(section, "Port", strings.Join(ports, ", "))
+		if capture.MaxSize > 0 {
+			setKey(section, "MaxSize", strconv.FormatInt(capture.MaxSize, 10))
+		}
+		if capture.Stream {
+			setKey(section, "Stream", strconv.FormatBool(capture.Stream))
+		}
+	}
+
+	if netstack := device.Netstack; netstack != nil {
+		section := newDumpSection(cfg, "Netstack")
+		setKey(section, "CongestionControl", netstack.CongestionControl)
+		if netstack.SACK != nil {
+			setKey(section, "SACK", strconv.FormatBool(*netstack.SACK))
+		}
+		if netstack.ModerateReceiveBuffer != nil {
+			setKey(section, "ModerateReceiveBuffer", strconv.FormatBool(*netstack.ModerateReceiveBuffer))
+		}
+		setInt(section, "ReceiveBufferMax", netstack.ReceiveBufferMax)
+		setInt(section, "SendBufferMax", netstack.SendBufferMax)
+		setInt(section, "KeepAlive", netstack.KeepAlive)
+		setInt(section, "KeepAliveInterval", netstack.KeepAliveInterval)
+		setInt(section, "ForwardBufferSize", netstack.ForwardBufferSize)
+	}
+
+	if accounting := device.Accounting; accounting != nil {
+		section := newDumpSection(cfg, "Accounting")
+		setKey(section, "StateFile", accounting.StateFile)
+	}
+
+	if uapi := device.UAPI; uapi != nil {
+		section := newDumpSection(cfg, "UAPI")
+		setKey(section, "Socket", uapi.Socket)
+		setKey(section, "Mode", fmt.Sprintf("%04o", uapi.Mode))
+		setKey(section, "Group", uapi.Group)
+	}
+
+	for _, spawner := range conf.Routines {
+		dumpRoutine(cfg, spawner)
+	}
+	return cfg
+}
+
+// dumpRoutine adds the section of a routine
+func dumpRoutine(cfg *ini.File, spawner RoutineSpawner) {
+	switch config := spawner.(type) {
+	case *TCPClientTunnelConfig:
+		section := newDumpSection(cfg, "TCPClientTunnel")
+		setKey(section, "BindAddress", config.bindAddress())
+		setKey(section, "SystemdSocket", config.SystemdSocket)
+		dumpSocketPermissions(section, config.SocketPermissions)
+		setKey(section, "Target", config.Target)
+		dumpLoadBalancing(section, config.LoadBalancing)
+		dumpConnTimeouts(section, config.ConnTimeouts)
+		dumpConnLimits(section, config.ConnLimits)
+	case *STDIOTunnelConfig:
+		section := newDumpSection(cfg, "STDIOTunnel")
+		setKey(section, "Target", config.Target)
+		dumpConnTimeouts(section, config.ConnTimeouts)
+	case *TCPServerTunnelConfig:
+		section := newDumpSection(cfg, "TCPServerTunnel")
+		setKey(section, "ListenPort", strconv.Itoa(config.ListenPort))
+		setKey(section, "Target", config.Target)
+		dumpLoadBalancing(section, config.LoadBalancing)
+		dumpConnTimeouts(section, config.ConnTimeouts)
+		dumpConnLimits(section, config.ConnLimits)
+	case *Socks5Config:
+		section := newDumpSection(cfg, "Socks5")
+		dumpProxy(section, config.BindAddress, config.SystemdSocket, config.Username, config.Password)
+		dumpSocketPermissions(section, config.SocketPermissions)
+		dumpConnTimeouts(section, config.ConnTimeouts)
+		dumpConnLimits(section, config.ConnLimits)
+		dumpQuota(section, config.Quota)
+	case *HTTPConfig:
+		section := newDumpSection(cfg, "http")
+		dumpProxy(section, config.BindAddress, config.SystemdSocket, config.Username, config.Password)
+		dumpSocketPermissions(section, config.SocketPermissions)
+		dumpConnTimeouts(section, config.ConnTimeouts)
+		dumpConnLimits(section, config.ConnLimits)
+		dumpQuota(section, config.Quota)
+	case *Socks5ServerConfig:
+		section := newDumpSection(cfg, "Socks5Server")
+		setKey(section, "ListenPort", strconv.Itoa(config.ListenPort))
+		dumpProxy(section, "", "", config.Username, config.Password)
+		dumpDestinationACL(section, config.DestinationACL)
+		dumpConnTimeouts(section, config.ConnTimeouts)
+		dumpConnLimits(section, config.ConnLimits)
+		dumpQuota(section, config.Quota)
+	case *HTTPServerConfig:
+		section := newDumpSection(cfg, "HTTPServer")
+		setKey(section, "ListenPort", strconv.Itoa(config.ListenPort))
+		dumpProxy(section, "", "", config.Username, config.Password)
+		dumpDestinationACL(section, config.DestinationACL)
+		dumpConnTimeouts(section, config.ConnTimeouts)
+		dumpConnLimits(section, config.ConnLimits)
+		dumpQuota(section, config.Quota)
+	case *TransparentProxyConfig:
+		section := newDumpSection(cfg, "TransparentProxy")
+		setKey(section, "BindAddress", config.BindAddress)
+		setKey(section, "Mode", config.Mode)
+		setKey(section, "UDP", strconv.FormatBool(config.UDP))
+		dumpConnTimeouts(section, config.ConnTimeouts)
+	}
+}
+
+func dumpProxy(section *ini.Section, bindAddress, systemdSocket, username, password string) {
+	setKey(section, "BindAddress", bindAddress)
+	setKey(section, "SystemdSocket", systemdSocket)
+	setKey(section, "Username", username)
+	if password != "" {
+		setKey(section, "Password", redacted)
+	}
+}
+
+func dumpSocketPermissions(section *ini.Section, perms SocketPermissions) {
+	if perms.SocketMode != 0 {
+		setKey(section, "SocketMode", fmt.Sprintf("%04o", perms.SocketMode))
+	}
+	setKey(section, "SocketOwner", perms.SocketOwner)
+}
+
+func dumpLoadBalancing(section *ini.Section, lb LoadBalancing) {
+	if len(lb.Targets) > 0 {
+		setKey(section, "Target", strings.Join(lb.Targets, ", "))
+		setKey(section, "Balance", lb.Balance)
+	}
+	setInt(section, "HealthCheckInterval", lb.HealthCheckInterval)
+	setInt(section, "HealthCheckTimeout", lb.HealthCheckTimeout)
+}
+
+func dumpDestinationACL(section *ini.Section, acl DestinationACL) {
+	prefixes := make([]string, 0, len(acl.AllowedIPs))
+	for _, prefix := range acl.AllowedIPs {
+		prefixes = append(prefixes, prefix.String())
+	}
+	setKey(section, "AllowedIPs", strings.Join(prefixes, ", "))
+	ports := make([]string, 0, len(acl.AllowedPorts))
+	for _, port := range acl.AllowedPorts {
+		ports = append(ports, strconv.Itoa(int(port)))
+	}
+	setKey(section, "AllowedPorts", strings.Join(ports, ", "))
+}
+
+func dumpConnTimeouts(section *ini.Section, timeouts ConnTimeouts) {
+	setInt(section, "IdleTimeout", timeouts.IdleTimeout)
+	setInt(section, "MaxLifetime", timeouts.MaxLifetime)
+}
+
+func dumpConnLimits(section *ini.Section, limits ConnLimits) {
+	setInt(section, "MaxConnections", limits.MaxConnections)
+	setInt(section, "MaxConnectionsPerIP", limits.MaxConnectionsPerIP)
+	if limits.ConnectionRate > 0 {
+		setKey(section, "ConnectionRate", strconv.FormatFloat(limits.ConnectionRate, 'f', -1, 64))
+	}
+	setInt(section, "Bandwidth", limits.Bandwidth)
+	setInt(section, "ConnectionBandwidth", limits.ConnectionBandwidth)
+}
+
+func dumpQuota(section *ini.Section, quota Quota) {
+	if quota.DailyQuota > 0 {
+		setKey(section, "DailyQuota", strconv.FormatInt(quota.DailyQuota, 10))
+	}
+	if quota.MonthlyQuota > 0 {
+		setKey(section, "MonthlyQuota", strconv.FormatInt(quota.MonthlyQuota, 10))
+	}
+}
+
+func newDumpSection(cfg *ini.File, name string) *ini.Section {
+	// sections can always be created as AllowNonUniqueSections is set
+	section, _ := cfg.NewSection(name)
+	return section
+}
+
+// setKey sets a key of a dumped section, unless its value is empty
+func setKey(section *ini.Section, name, value string) {
+	if value != "" {
+		_, _ = section.NewKey(name, value)
+	}
+}
+
+// setInt sets an integer key of a dumped section, unless it is 0
+func setInt(section *ini.Section, name string, value int) {
+	if value != 0 {
+		setKey(section, name, strconv.Itoa(value))
+	}
+}
+
+func joinAddrs(addrs []netip.Addr) string {
+	strs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+	}
+	return strings.Join(strs, ", ")
+}
+
+func hexToBase64(key string) string {
+	decoded, err := hex.DecodeString(key)
+	if err != nil {
+		return key
+	}
+	return base64.StdEncoding.EncodeToString(decoded)
+}
+
+// iniToDocument is the inverse of documentToINI, with sections which may appear several times as lists
+func iniToDocument(cfg *ini.File) map[string]interface{} {
+	document := make(map[string]interface{})
+	for _, section := range cfg.Sections() {
+		keys := make(map[string]interface{})
+		for _, key := range section.Keys() {
+			keys[key.Name()] = key.Value()
+		}
+		if section.Name() == ini.DefaultSection {
+			for name, value := range keys {
+				document[name] = value
+			}
+			continue
+		}
+
+		single := false
+		for _, name := range singleSections {
+			single = single || name == section.Name()
+		}
+		if single {
+			document[section.Name()] = keys
+		} else {
+			list, _ := document[section.Name()].([]interface{})
+			document[section.Name()] = append(list, keys)
+		}
+	}
+	return document
+}
+
+// serveConfig serves the effective configuration, as JSON with ?format=json and as INI otherwise
+func serveConfig(w http.ResponseWriter, r *http.Request, conf *Configuration) {
+	format := FormatINI
+	contentType := "text/plain; charset=utf-8"
+	if r.URL.Query().Get("format") == FormatJSON {
+		format = FormatJSON
+		contentType = "application/json"
+	}
+
+	data, err := DumpConfig(conf, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,166 @@
+package wireproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// closeWriter is implemented by connections supporting half-close, such as TCP connections
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite half-closes `inner` when it supports it, and otherwise closes the wrapper `outer` entirely
+func closeWrite(inner any, outer io.Closer) error {
+	if conn, ok := inner.(closeWriter); ok {
+		return conn.CloseWrite()
+	}
+	return outer.Close()
+}
+
+// readerConn is a net.Conn whose reads come from Reader, e.g. a bufio.Reader which
+// already consumed data from the connection
+type readerConn struct {
+	io.Reader
+	net.Conn
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+func (c *readerConn) CloseWrite() error {
+	return closeWrite(c.Conn, c.Conn)
+}
+
+// initialStdout is standard output as the process started. os.Stdout is remapped to stderr by the
+// wireproxy command, and /dev/stdout can't be reopened once sandboxed. Keeping this reference
+// also prevents the finalizer of the original os.Stdout from closing the file descriptor.
+var initialStdout = os.Stdout
+
+// stdioConn joins standard input and output into a single connection,
+// closing standard output being its half-close
+type stdioConn struct {
+	in  *os.File
+	out *os.File
+}
+
+func (c *stdioConn) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+func (c *stdioConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+func (c *stdioConn) CloseWrite() error {
+	return c.out.Close()
+}
+
+func (c *stdioConn) Close() error {
+	return errors.Join(c.in.Close(), c.out.Close())
+}
+
+// defaultForwardBufferSize is the size of the buffers of connForward unless set in [Netstack]
+const defaultForwardBufferSize = 32 * 1024
+
+// connForward copies data between `a` and `b` in both directions with buffers of `bufferSize` bytes,
+// until both directions are done. When one side stops sending, the other side is half-closed so
+// that it still can reply. Both connections are closed once they idle out or reach their lifetime
+// as set by `timeouts`.
+func connForward(a io.ReadWriteCloser, b io.ReadWriteCloser, bufferSize int, timeouts ConnTimeouts, logger *device.Logger) {
+	var lastActivity atomic.Int64
+	var closed atomic.Bool
+	lastActivity.Store(time.Now().UnixNano())
+
+	closeBoth := func() {
+		if closed.CompareAndSwap(false, true) {
+			_ = a.Close()
+			_ = b.Close()
+		}
+	}
+
+	var wg sync.WaitGroup
+	copyHalf := func(dst io.ReadWriteCloser, src io.ReadWriteCloser) {
+		defer wg.Done()
+
+		buf := make([]byte, bufferSize)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				lastActivity.Store(time.Now().UnixNano())
+				if _, err := dst.Write(buf[:n]); err != nil {
+					if !closed.Load() {
+						logger.Errorf("Cannot forward traffic: %s", err.Error())
+					}
+					closeBoth()
+					return
+				}
+			}
+
+			if errors.Is(err, io.EOF) {
+				if conn, ok := dst.(closeWriter); ok {
+					_ = conn.CloseWrite()
+				} else {
+					closeBoth()
+				}
+				return
+			}
+			if err != nil {
+				if !closed.Load() {
+					logger.Errorf("Cannot forward traffic: %s", err.Error())
+				}
+				closeBoth()
+				return
+			}
+		}
+	}
+
+	wg.Add(2)
+	go copyHalf(b, a)
+	go copyHalf(a, b)
+
+	done := make(chan struct{})
+	if timeouts.IdleTimeout > 0 || timeouts.MaxLifetime > 0 {
+		go watchConn(done, &lastActivity, timeouts, closeBoth)
+	}
+
+	wg.Wait()
+	close(done)
+	closeBoth()
+}
+
+// watchConn calls `expire` once the connection idles out or reaches its lifetime
+func watchConn(done <-chan struct{}, lastActivity *atomic.Int64, timeouts ConnTimeouts, expire func()) {
+	idleTimeout := time.Duration(timeouts.IdleTimeout) * time.Second
+	var lifetime <-chan time.Time
+	if timeouts.MaxLifetime > 0 {
+		timer := time.NewTimer(time.Duration(timeouts.MaxLifetime) * time.Second)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-lifetime:
+			expire()
+			return
+		case now := <-ticker.C:
+			if idleTimeout > 0 && now.Sub(time.Unix(0, lastActivity.Load())) > idleTimeout {
+				expire()
+				return
+			}
+		}
+	}
+}
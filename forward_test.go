@@ -0,0 +1,127 @@
+package wireproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+// forward runs connForward between `a` and `b` and returns a channel closed once it returns
+func forward(a, b io.ReadWriteCloser, timeouts ConnTimeouts) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		connForward(a, b, defaultForwardBufferSize, timeouts, device.NewLogger(device.LogLevelSilent, ""))
+	}()
+	return done
+}
+
+func waitForward(t *testing.T, done <-chan struct{}, timeout time.Duration) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("expected the connections to be closed")
+	}
+}
+
+func TestConnForwardHalfClose(t *testing.T) {
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+	done := forward(a, b, ConnTimeouts{})
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	// the server gets the request followed by EOF, but can still reply
+	request, err := io.ReadAll(server)
+	if err != nil || string(request) != "hello" {
+		t.Fatalf("unexpected request %q, %v", request, err)
+	}
+	if _, err := server.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	_ = server.Close()
+
+	reply, err := io.ReadAll(client)
+	if err != nil || string(reply) != "world" {
+		t.Fatalf("unexpected reply %q, %v", reply, err)
+	}
+	waitForward(t, done, 5*time.Second)
+}
+
+func TestConnForwardWithoutHalfClose(t *testing.T) {
+	client, a := net.Pipe()
+	b, server := net.Pipe()
+	done := forward(a, b, ConnTimeouts{})
+
+	// pipes can't be half-closed, so the end of one direction closes both
+	_ = client.Close()
+	waitForward(t, done, 5*time.Second)
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the other side to be closed")
+	}
+}
+
+func TestConnForwardTimeouts(t *testing.T) {
+	t.Run("idle", func(t *testing.T) {
+		_, a := net.Pipe()
+		b, _ := net.Pipe()
+		start := time.Now()
+		waitForward(t, forward(a, b, ConnTimeouts{IdleTimeout: 1}), 5*time.Second)
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Errorf("closed after %s, before the idle timeout", elapsed)
+		}
+	})
+
+	t.Run("lifetime", func(t *testing.T) {
+		client, a := net.Pipe()
+		b, server := net.Pipe()
+		done := forward(a, b, ConnTimeouts{IdleTimeout: 1, MaxLifetime: 2})
+		go func() { _, _ = io.Copy(io.Discard, server) }()
+
+		// the connection never idles, but still expires at the end of its lifetime
+		start := time.Now()
+		go func() {
+			for {
+				if _, err := client.Write([]byte("ping")); err != nil {
+					return
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+		waitForward(t, done, 5*time.Second)
+		if elapsed := time.Since(start); elapsed < 2*time.Second {
+			t.Errorf("closed after %s, before the lifetime", elapsed)
+		}
+	})
+}
@@ -3,13 +3,15 @@ package wireproxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
-	"io"
-	"log"
 	"net"
 	"net/http"
 	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
 )
 
 const proxyAuthHeaderKey = "Proxy-Authorization"
@@ -17,35 +19,39 @@ const proxyAuthHeaderKey = "Proxy-Authorization"
 type HTTPServer struct {
 	config *HTTPConfig
 
-	auth CredentialValidator
-	dial func(network, address string) (net.Conn, error)
+	auth       CredentialValidator
+	dial       func(network, address string) (net.Conn, error)
+	accounting *Accounting
+	logger     *device.Logger
+	// bufferSize is the size of the buffers forwarding the data of CONNECT requests
+	bufferSize int
 
 	authRequired bool
 }
 
-func (s *HTTPServer) authenticate(req *http.Request) (int, error) {
+func (s *HTTPServer) authenticate(req *http.Request) (string, int, error) {
 	if !s.authRequired {
-		return 0, nil
+		return "", 0, nil
 	}
 
 	auth := req.Header.Get(proxyAuthHeaderKey)
 	if auth == "" {
-		return http.StatusProxyAuthRequired, fmt.Errorf("%s", http.StatusText(http.StatusProxyAuthRequired))
+		return "", http.StatusProxyAuthRequired, fmt.Errorf("%s", http.StatusText(http.StatusProxyAuthRequired))
 	}
 
 	enc := strings.TrimPrefix(auth, "Basic ")
 	str, err := base64.StdEncoding.DecodeString(enc)
 	if err != nil {
-		return http.StatusNotAcceptable, fmt.Errorf("decode username and password failed: %w", err)
+		return "", http.StatusNotAcceptable, fmt.Errorf("decode username and password failed: %w", err)
 	}
 	pairs := bytes.SplitN(str, []byte(":"), 2)
 	if len(pairs) != 2 {
-		return http.StatusLengthRequired, fmt.Errorf("username and password format invalid")
+		return "", http.StatusLengthRequired, fmt.Errorf("username and password format invalid")
 	}
 	if s.auth.Valid(string(pairs[0]), string(pairs[1])) {
-		return 0, nil
+		return string(pairs[0]), 0, nil
 	}
-	return http.StatusUnauthorized, fmt.Errorf("username and password not matching")
+	return "", http.StatusUnauthorized, fmt.Errorf("username and password not matching")
 }
 
 func (s *HTTPServer) handleConn(req *http.Request, conn net.Conn) (peer net.Conn, err error) {
@@ -92,21 +98,29 @@ func (s *HTTPServer) handle(req *http.Request) (peer net.Conn, err error) {
 }
 
 func (s *HTTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
 	var rd = bufio.NewReader(conn)
 	req, err := http.ReadRequest(rd)
 	if err != nil {
-		log.Printf("read request failed: %s\n", err)
+		s.logger.Errorf("read request failed: %s", err)
 		return
 	}
 
-	code, err := s.authenticate(req)
+	username, code, err := s.authenticate(req)
 	if err != nil {
 		resp := responseWith(req, code)
 		if code == http.StatusProxyAuthRequired {
 			resp.Header.Set("Proxy-Authenticate", "Basic realm=\"Proxy\"")
 		}
 		_ = resp.Write(conn)
-		log.Println(err)
+		s.logger.Errorf("%s", err)
+		return
+	}
+
+	if username != "" && s.accounting.Exceeded(username, s.config.Quota) {
+		_ = responseWith(req, http.StatusForbidden).Write(conn)
+		s.logger.Errorf("quota of %s exceeded", username)
 		return
 	}
 
@@ -118,44 +132,56 @@ func (s *HTTPServer) serve(conn net.Conn) {
 		peer, err = s.handle(req)
 	default:
 		_ = responseWith(req, http.StatusMethodNotAllowed).Write(conn)
-		log.Printf("unsupported protocol: %s\n", req.Method)
+		s.logger.Errorf("unsupported protocol: %s", req.Method)
 		return
 	}
 	if err != nil {
-		log.Printf("dial proxy failed: %s\n", err)
+		s.logger.Errorf("dial proxy failed: %s", err)
 		return
 	}
 	if peer == nil {
-		log.Println("dial proxy failed: peer nil")
+		s.logger.Errorf("dial proxy failed: peer nil")
 		return
 	}
 
-	go func() {
-		defer conn.Close()
-		defer peer.Close()
-
-		_, _ = io.Copy(conn, peer)
-	}()
+	client := s.accounting.account(&readerConn{Reader: rd, Conn: conn}, username)
+	connForward(client, peer, s.bufferSize, s.config.ConnTimeouts, s.logger)
+}
 
-	go func() {
-		defer conn.Close()
-		defer peer.Close()
+// reject answers a client over the connection limits with 503 Service Unavailable
+func (s *HTTPServer) reject(conn net.Conn) {
+	defer conn.Close()
 
-		_, _ = io.Copy(peer, conn)
-	}()
+	_ = conn.SetDeadline(time.Now().Add(rejectTimeout))
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	_ = responseWith(req, http.StatusServiceUnavailable).Write(conn)
 }
 
-// ListenAndServe is used to create a listener and serve on it
-func (s *HTTPServer) ListenAndServe(network, addr string) error {
-	server, err := net.Listen(network, addr)
+// ListenAndServe is used to create a listener and serve on it until `ctx` is done
+func (s *HTTPServer) ListenAndServe(ctx context.Context, network, addr string) error {
+	listener, err := net.Listen(network, addr)
 	if err != nil {
 		return fmt.Errorf("listen tcp failed: %w", err)
 	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve serves on `listener` until `ctx` is done
+func (s *HTTPServer) Serve(ctx context.Context, listener net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stop()
+	server := trackConnections(ctx, newLimitedListener(retryListener{listener, s.logger}, s.config.ConnLimits, s.reject, s.logger))
 	defer func(server net.Listener) {
 		_ = server.Close()
 	}(server)
 	for {
 		conn, err := server.Accept()
+		if ctx.Err() != nil {
+			return nil
+		}
 		if err != nil {
 			return fmt.Errorf("accept request failed: %w", err)
 		}
@@ -0,0 +1,272 @@
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// Instance is a wireguard tunnel with its routines, for embedding wireproxy into Go programs.
+//
+// The configuration may come from ParseConfig, or be built in code, in which case the keys
+// are hex encoded (see KeyToHex) and the defaults of the configuration file apply to unset fields.
+type Instance struct {
+	conf   *Configuration
+	logger *device.Logger
+	// deviceLogger receives the messages of the wireguard device, logger when nil
+	deviceLogger *device.Logger
+
+	lock   sync.Mutex
+	tun    *VirtualTun
+	cancel context.CancelFunc
+}
+
+// Option customizes an Instance
+type Option func(*Instance)
+
+// WithLogger makes the instance and its wireguard device log to `logger`.
+// By default, only errors are logged to stderr.
+func WithLogger(logger *device.Logger) Option {
+	return func(i *Instance) {
+		i.logger = logger
+	}
+}
+
+// WithDeviceLogger makes the wireguard device log to `logger` instead of the logger of the instance,
+// e.g. to silence it while still logging the errors of the routines
+func WithDeviceLogger(logger *device.Logger) Option {
+	return func(i *Instance) {
+		i.deviceLogger = logger
+	}
+}
+
+// KeyToHex converts a base64 encoded wireguard key, as found in wireguard configuration
+// files, into the hex encoding expected in DeviceConfig and PeerConfig
+func KeyToHex(key string) (string, error) {
+	return encodeBase64ToHex(key)
+}
+
+// New checks `conf` and creates an instance, which does nothing until it is started.
+// The instance works on a copy of the device configuration with the defaults filled in,
+// the routines are shared with `conf` and only read, so they must not be modified afterwards.
+func New(conf *Configuration, options ...Option) (*Instance, error) {
+	if conf == nil || conf.Device == nil {
+		return nil, errors.New("a device configuration is required")
+	}
+	if conf.Device.SecretKey == "" {
+		return nil, errors.New("SecretKey should not be empty")
+	}
+	if len(conf.Device.Endpoint) == 0 {
+		return nil, errors.New("at least one Address is required")
+	}
+	conf = &Configuration{Device: cloneDeviceConfig(conf.Device), Routines: slices.Clone(conf.Routines)}
+	setDefaults(conf.Device)
+
+	i := &Instance{
+		conf: conf,
+		logger: &device.Logger{
+			Verbosef: device.DiscardLogf,
+			Errorf:   log.New(os.Stderr, "ERROR: ", log.LstdFlags).Printf,
+		},
+	}
+	for _, option := range options {
+		option(i)
+	}
+	return i, nil
+}
+
+// setDefaults fills the fields a configuration file would have defaulted
+// cloneDeviceConfig copies `conf` and everything it points to
+func cloneDeviceConfig(conf *DeviceConfig) *DeviceConfig {
+	clone := *conf
+	clone.Endpoint = slices.Clone(conf.Endpoint)
+	clone.DNS = slices.Clone(conf.DNS)
+	clone.CheckAlive = slices.Clone(conf.CheckAlive)
+	clone.ListenPort = clonePointer(conf.ListenPort)
+	clone.Peers = slices.Clone(conf.Peers)
+	for i, peer := range clone.Peers {
+		clone.Peers[i].Endpoint = clonePointer(peer.Endpoint)
+		clone.Peers[i].AllowedIPs = slices.Clone(peer.AllowedIPs)
+	}
+	if conf.TUN != nil {
+		clone.TUN = clonePointer(conf.TUN)
+		clone.TUN.FD = clonePointer(conf.TUN.FD)
+		clone.TUN.Address = slices.Clone(conf.TUN.Address)
+	}
+	if conf.Capture != nil {
+		clone.Capture = clonePointer(conf.Capture)
+		clone.Capture.Filter.Hosts = slices.Clone(conf.Capture.Filter.Hosts)
+		clone.Capture.Filter.Ports = slices.Clone(conf.Capture.Filter.Ports)
+	}
+	if conf.Netstack != nil {
+		clone.Netstack = clonePointer(conf.Netstack)
+		clone.Netstack.SACK = clonePointer(conf.Netstack.SACK)
+		clone.Netstack.ModerateReceiveBuffer = clonePointer(conf.Netstack.ModerateReceiveBuffer)
+	}
+	clone.Accounting = clonePointer(conf.Accounting)
+	clone.UAPI = clonePointer(conf.UAPI)
+	return &clone
+}
+
+// clonePointer returns a pointer to a copy of *p, or nil
+func clonePointer[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	clone := *p
+	return &clone
+}
+
+func setDefaults(conf *DeviceConfig) {
+	if conf.MTU == 0 {
+		conf.MTU = 1420
+	}
+	if conf.CheckAliveInterval == 0 {
+		conf.CheckAliveInterval = 5
+	}
+	if conf.Netstack != nil && conf.Netstack.KeepAliveInterval == 0 {
+		conf.Netstack.KeepAliveInterval = 75
+	}
+	for i := range conf.Peers {
+		if conf.Peers[i].PreSharedKey == "" {
+			conf.Peers[i].PreSharedKey = "0000000000000000000000000000000000000000000000000000000000000000"
+		}
+	}
+}
+
+// Start brings the wireguard device up and spawns the routines of the configuration.
+// The instance is closed once `ctx` is done.
+func (i *Instance) Start(ctx context.Context) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.tun != nil {
+		return errors.New("instance already started")
+	}
+
+	deviceLogger := i.deviceLogger
+	if deviceLogger == nil {
+		deviceLogger = i.logger
+	}
+	tun, err := startWireguard(i.conf.Device, i.logger, deviceLogger)
+	if err != nil {
+		return err
+	}
+	if i.conf.Device.UAPI != nil {
+		if err := tun.ServeUAPI(i.conf.Device.UAPI); err != nil {
+			_ = tun.Close()
+			return err
+		}
+	}
+
+	routineCtx, cancel := context.WithCancel(ctx)
+	for _, spawner := range i.conf.Routines {
+		tun.Routines.Spawn(routineCtx, tun, spawner)
+	}
+	tun.StartPingIPs()
+	tun.StartMTUDiscovery()
+
+	tun.config = i.conf
+	i.tun = tun
+	i.cancel = cancel
+	context.AfterFunc(routineCtx, func() {
+		_ = i.Close()
+	})
+	return nil
+}
+
+// Close stops the routines and shuts the wireguard device down
+func (i *Instance) Close() error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.tun == nil {
+		return nil
+	}
+	i.cancel()
+	err := i.tun.Close()
+	i.tun = nil
+	return err
+}
+
+// VirtualTun returns the tunnel of a started instance, e.g. to serve its health endpoint
+func (i *Instance) VirtualTun() *VirtualTun {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.tun
+}
+
+func (i *Instance) started() (*VirtualTun, error) {
+	tun := i.VirtualTun()
+	if tun == nil {
+		return nil, errors.New("instance not started")
+	}
+	return tun, nil
+}
+
+// Dial connects to `address` via wireguard. Hostnames are resolved with the DNS of the configuration.
+func (i *Instance) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	tun, err := i.started()
+	if err != nil {
+		return nil, err
+	}
+	return tun.DialContext(ctx, network, address)
+}
+
+// Listen accepts TCP connections on `address` of the wireguard side, e.g. ":8080"
+func (i *Instance) Listen(network, address string) (net.Listener, error) {
+	tun, err := i.started()
+	if err != nil {
+		return nil, err
+	}
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("unsupported network " + network)
+	}
+
+	addrPort, err := parseListenAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	return tun.Tnet.ListenTCPAddrPort(addrPort)
+}
+
+// ListenPacket receives UDP packets on `address` of the wireguard side, e.g. ":53"
+func (i *Instance) ListenPacket(network, address string) (net.PacketConn, error) {
+	tun, err := i.started()
+	if err != nil {
+		return nil, err
+	}
+	if network != "udp" && network != "udp4" && network != "udp6" {
+		return nil, errors.New("unsupported network " + network)
+	}
+
+	addrPort, err := parseListenAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	return tun.Tnet.ListenUDPAddrPort(addrPort)
+}
+
+// parseListenAddress parses an address to listen on, whose host may be omitted
+func parseListenAddress(address string) (netip.AddrPort, error) {
+	target, err := parseAddressPort(address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if target.address == "" {
+		return netip.AddrPortFrom(netip.Addr{}, target.port), nil
+	}
+
+	addr, err := netip.ParseAddr(target.address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, target.port), nil
+}
@@ -0,0 +1,208 @@
+package wireproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func generateHexKeyPair(t *testing.T) (string, string) {
+	private, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := PublicKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateHex, _ := encodeBase64ToHex(private)
+	publicHex, _ := encodeBase64ToHex(public)
+	return privateHex, publicHex
+}
+
+func TestInstanceDialListen(t *testing.T) {
+	serverPrivate, serverPublic := generateHexKeyPair(t)
+	clientPrivate, clientPublic := generateHexKeyPair(t)
+	// find a free port for the server
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenPort := udp.LocalAddr().(*net.UDPAddr).Port
+	_ = udp.Close()
+	endpoint := fmt.Sprintf("127.0.0.1:%d", listenPort)
+
+	socket := filepath.Join(t.TempDir(), "wg0.sock")
+	serverConf := &Configuration{Device: &DeviceConfig{
+		SecretKey:  serverPrivate,
+		Endpoint:   []netip.Addr{netip.MustParseAddr("10.10.0.1")},
+		ListenPort: &listenPort,
+		Peers: []PeerConfig{{
+			PublicKey:  clientPublic,
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.10.0.2/32")},
+		}},
+		UAPI: &UAPIConfig{Socket: socket, Mode: 0600, GID: -1},
+	}}
+	server, err := New(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverConf.Device.MTU != 0 || serverConf.Device.Peers[0].PreSharedKey != "" {
+		t.Fatal("New should not fill in the defaults of the configuration it is given")
+	}
+	if server.conf.Device.UAPI == serverConf.Device.UAPI || server.conf.Device.ListenPort == serverConf.Device.ListenPort ||
+		&server.conf.Device.Peers[0].AllowedIPs[0] == &serverConf.Device.Peers[0].AllowedIPs[0] {
+		t.Fatal("New should not share the device configuration it is given")
+	}
+
+	client, err := New(&Configuration{Device: &DeviceConfig{
+		SecretKey: clientPrivate,
+		Endpoint:  []netip.Addr{netip.MustParseAddr("10.10.0.2")},
+		Peers: []PeerConfig{{
+			PublicKey:  serverPublic,
+			Endpoint:   &endpoint,
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.10.0.1/32")},
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	listener, err := server.Listen("tcp", ":8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := client.Dial(ctx, "tcp", "10.10.0.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "hello" {
+		t.Fatalf("expected hello, got %s", reply)
+	}
+
+	status, err := client.VirtualTun().Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Peers) != 1 || status.Peers[0].LatestHandshake == nil || status.Peers[0].ReceivedBytes == 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	uapi, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uapi.Close()
+	if _, err := uapi.Write([]byte("get=1\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	// the response ends with the errno of the operation
+	var ipc string
+	scanner := bufio.NewScanner(uapi)
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "errno=") {
+		ipc += scanner.Text() + "\n"
+	}
+	if peers := parseIpcStatus(ipc).Peers; len(peers) != 1 || peers[0].PublicKey != hexToBase64(clientPublic) {
+		t.Errorf("unexpected UAPI response %q", ipc)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wireproxy.sock")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket(path); err == nil || !strings.Contains(err.Error(), "is not a socket") {
+		t.Errorf("expected a regular file to be kept, got %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error(err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket(path); err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("expected a socket in use to be kept, got %v", err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = listener.Close()
+	if err := removeStaleSocket(path); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the stale socket to be removed, got %v", err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wireproxy.sock")
+	listener, err := listenUnix(path, SocketPermissions{SocketMode: 0600, SocketUID: -1, SocketGID: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected socket mode %s", fi.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected the temporary directory to be removed, found %d entries", len(entries))
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed on close, got %v", err)
+	}
+}
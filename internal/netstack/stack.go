@@ -0,0 +1,14 @@
+package netstack
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// NICID is the id of the network interface of the stack, through which wireguard packets go
+const NICID tcpip.NICID = 1
+
+// Stack returns the gVisor stack of the network, e.g. to set its TCP options
+func (net *Net) Stack() *stack.Stack {
+	return net.stack
+}
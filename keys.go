@@ -0,0 +1,45 @@
+package wireproxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// GeneratePresharedKey returns a new base64 encoded preshared key, like wg genpsk
+func GeneratePresharedKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// GeneratePrivateKey returns a new base64 encoded private key, like wg genkey
+func GeneratePrivateKey() (string, error) {
+	key := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	// clamp the key as wg does
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// PublicKey derives the base64 encoded public key of a base64 encoded private key, like wg pubkey
+func PublicKey(privateKey string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privateKey))
+	if err != nil || len(key) != curve25519.ScalarSize {
+		return "", errors.New("invalid private key")
+	}
+
+	public, err := curve25519.X25519(key, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(public), nil
+}
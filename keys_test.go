@@ -0,0 +1,54 @@
+package wireproxy
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPublicKey(t *testing.T) {
+	// Alice's key pair from RFC 7748 section 6.1
+	private, _ := hex.DecodeString("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	public, _ := hex.DecodeString("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")
+
+	key, err := PublicKey(base64.StdEncoding.EncodeToString(private) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != base64.StdEncoding.EncodeToString(public) {
+		t.Errorf("PublicKey = %s, want %s", key, base64.StdEncoding.EncodeToString(public))
+	}
+
+	for _, invalid := range []string{"", "not base64", base64.StdEncoding.EncodeToString(private[:31])} {
+		if _, err := PublicKey(invalid); err == nil {
+			t.Errorf("PublicKey(%q) should fail", invalid)
+		}
+	}
+}
+
+func TestGenerateKeys(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		privateKey, err := GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		private, err := base64.StdEncoding.DecodeString(privateKey)
+		if err != nil || len(private) != 32 {
+			t.Fatalf("GeneratePrivateKey returned %q", privateKey)
+		}
+		if private[0]&7 != 0 || private[31]&128 != 0 || private[31]&64 == 0 {
+			t.Errorf("private key %x is not clamped", private)
+		}
+		if _, err := PublicKey(privateKey); err != nil {
+			t.Error(err)
+		}
+
+		presharedKey, err := GeneratePresharedKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if preshared, err := base64.StdEncoding.DecodeString(presharedKey); err != nil || len(preshared) != 32 {
+			t.Errorf("GeneratePresharedKey returned %q", presharedKey)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package wireproxy
+
+import (
+	"context"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// rejectTimeout is how long a rejected client may take to receive the reason of its rejection
+const rejectTimeout = 5 * time.Second
+
+// maxRejecting is how many rejected clients may be told the reason at once, the connections
+// of the others are closed right away so that a flood doesn't pile up goroutines
+const maxRejecting = 64
+
+// limitedListener enforces ConnLimits on the connections accepted by a listener.
+// Connections over the limits are handed to reject instead of being returned by Accept.
+type limitedListener struct {
+	net.Listener
+	limits ConnLimits
+	reject func(net.Conn)
+	logger *device.Logger
+	// rejecting holds a slot for every client being rejected
+	rejecting chan struct{}
+
+	connRate  *rate.Limiter
+	bandwidth *rate.Limiter
+
+	lock   sync.Mutex
+	active int
+	perIP  map[string]int
+}
+
+// newLimitedListener wraps `l` so that it enforces `limits`. Rejected connections are passed
+// to `reject`, which may tell the client why before closing the connection.
+func newLimitedListener(l net.Listener, limits ConnLimits, reject func(net.Conn), logger *device.Logger) net.Listener {
+	if limits == (ConnLimits{}) {
+		return l
+	}
+
+	listener := &limitedListener{
+		Listener:  l,
+		limits:    limits,
+		reject:    reject,
+		logger:    logger,
+		rejecting: make(chan struct{}, maxRejecting),
+		perIP:     make(map[string]int),
+	}
+	if limits.ConnectionRate > 0 {
+		burst := int(math.Max(1, math.Ceil(limits.ConnectionRate)))
+		listener.connRate = rate.NewLimiter(rate.Limit(limits.ConnectionRate), burst)
+	}
+	if limits.Bandwidth > 0 {
+		listener.bandwidth = rate.NewLimiter(rate.Limit(limits.Bandwidth), limits.Bandwidth)
+	}
+	return listener
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := remoteIP(conn)
+		if reason := l.admit(ip); reason != "" {
+			l.logger.Errorf("Rejected connection from %s: %s", conn.RemoteAddr(), reason)
+			select {
+			case l.rejecting <- struct{}{}:
+				go func() {
+					defer func() { <-l.rejecting }()
+					l.reject(conn)
+				}()
+			default:
+				_ = conn.Close()
+			}
+			continue
+		}
+
+		return l.wrap(conn, ip), nil
+	}
+}
+
+// admit reserves a connection slot for a client, and returns why it is rejected otherwise
+func (l *limitedListener) admit(ip string) string {
+	if l.connRate != nil && !l.connRate.Allow() {
+		return "connection rate exceeded"
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.limits.MaxConnections > 0 && l.active >= l.limits.MaxConnections {
+		return "too many connections"
+	}
+	if l.limits.MaxConnectionsPerIP > 0 && l.perIP[ip] >= l.limits.MaxConnectionsPerIP {
+		return "too many connections from this address"
+	}
+
+	l.active++
+	l.perIP[ip]++
+	return ""
+}
+
+// release frees the connection slot of a client
+func (l *limitedListener) release(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.active--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+func (l *limitedListener) wrap(conn net.Conn, ip string) net.Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	limited := &limitedConn{
+		Conn:    conn,
+		ctx:     ctx,
+		cancel:  cancel,
+		release: func() { l.release(ip) },
+	}
+
+	if l.bandwidth != nil {
+		limited.limiters = append(limited.limiters, l.bandwidth)
+	}
+	if bandwidth := l.limits.ConnectionBandwidth; bandwidth > 0 {
+		limited.limiters = append(limited.limiters, rate.NewLimiter(rate.Limit(bandwidth), bandwidth))
+	}
+
+	limited.chunk = math.MaxInt
+	for _, limiter := range limited.limiters {
+		limited.chunk = min(limited.chunk, limiter.Burst())
+	}
+	return limited
+}
+
+// remoteIP returns the address of the client without its port
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// limitedConn shapes the traffic of a connection in both directions,
+// and frees its slot in the listener once closed
+type limitedConn struct {
+	net.Conn
+	limiters []*rate.Limiter
+	// chunk is the largest amount of bytes every limiter can grant at once
+	chunk int
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	release func()
+	once    sync.Once
+}
+
+// wait blocks until every limiter grants `n` bytes
+func (c *limitedConn) wait(n int) error {
+	for _, limiter := range c.limiters {
+		if err := limiter.WaitN(c.ctx, n); err != nil {
+			return net.ErrClosed
+		}
+	}
+	return nil
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(p) > c.chunk {
+		p = p[:c.chunk]
+	}
+
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if waitErr := c.wait(n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := min(len(p), written+c.chunk)
+		if err := c.wait(end - written); err != nil {
+			return written, err
+		}
+
+		n, err := c.Conn.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *limitedConn) CloseWrite() error {
+	return closeWrite(c.Conn, c)
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() {
+		c.cancel()
+		c.release()
+	})
+	return c.Conn.Close()
+}
+
+// closeConn rejects a connection by closing it, for protocols without any way to report errors
+func closeConn(conn net.Conn) {
+	_ = conn.Close()
+}
@@ -0,0 +1,171 @@
+package wireproxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// pipeListener accepts the server ends of pipes opened by dial
+type pipeListener struct {
+	conns chan net.Conn
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (l *pipeListener) Close() error {
+	close(l.conns)
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// remoteConn overrides the address of the client of a pipe
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// dial opens a connection from `ip` to the listener and returns the client end
+func (l *pipeListener) dial(ip string) net.Conn {
+	client, server := net.Pipe()
+	l.conns <- &remoteConn{Conn: server, remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}}
+	return client
+}
+
+// limitedPipeListener returns a pipe listener enforcing `limits`, and the channel the rejected connections are sent to
+func limitedPipeListener(limits ConnLimits) (*pipeListener, net.Listener, <-chan net.Conn) {
+	pipes := &pipeListener{conns: make(chan net.Conn, 8)}
+	rejected := make(chan net.Conn, 8)
+	listener := newLimitedListener(pipes, limits, func(conn net.Conn) {
+		rejected <- conn
+	}, device.NewLogger(device.LogLevelSilent, ""))
+	return pipes, listener, rejected
+}
+
+func accept(t *testing.T, listener net.Listener) net.Conn {
+	t.Helper()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func expectRejected(t *testing.T, rejected <-chan net.Conn, ip string) {
+	t.Helper()
+	select {
+	case conn := <-rejected:
+		if remoteIP(conn) != ip {
+			t.Errorf("expected the connection from %s to be rejected, got %s", ip, conn.RemoteAddr())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the connection from %s to be rejected", ip)
+	}
+}
+
+func TestLimitedListenerPerIP(t *testing.T) {
+	pipes, listener, rejected := limitedPipeListener(ConnLimits{MaxConnectionsPerIP: 1})
+
+	pipes.dial("192.0.2.1")
+	first := accept(t, listener)
+
+	pipes.dial("192.0.2.1")
+	pipes.dial("192.0.2.2")
+	if conn := accept(t, listener); remoteIP(conn) != "192.0.2.2" {
+		t.Errorf("expected the connection from another address to be accepted, got %s", conn.RemoteAddr())
+	}
+	expectRejected(t, rejected, "192.0.2.1")
+
+	// closing the connection frees the slot of its address
+	_ = first.Close()
+	pipes.dial("192.0.2.1")
+	if conn := accept(t, listener); remoteIP(conn) != "192.0.2.1" {
+		t.Errorf("expected the freed slot to be reused, got %s", conn.RemoteAddr())
+	}
+}
+
+func TestLimitedListenerRate(t *testing.T) {
+	pipes, listener, rejected := limitedPipeListener(ConnLimits{ConnectionRate: 1})
+	defer listener.Close()
+
+	pipes.dial("192.0.2.1")
+	accept(t, listener)
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	pipes.dial("192.0.2.2")
+	expectRejected(t, rejected, "192.0.2.2")
+
+	// a new connection is allowed once the rate refilled
+	time.Sleep(time.Second)
+	pipes.dial("192.0.2.3")
+	select {
+	case conn := <-accepted:
+		if remoteIP(conn) != "192.0.2.3" {
+			t.Errorf("unexpected connection from %s", conn.RemoteAddr())
+		}
+	case <-rejected:
+		t.Error("expected the connection to be accepted after a second")
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection to be accepted after a second")
+	}
+}
+
+func TestLimitedListenerBandwidth(t *testing.T) {
+	const bandwidth = 10000
+
+	// sends one second worth of data on two connections at once, and returns how long it took
+	transfer := func(limits ConnLimits) time.Duration {
+		pipes, listener, _ := limitedPipeListener(limits)
+		defer listener.Close()
+
+		start := time.Now()
+		var wg sync.WaitGroup
+		for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+			client := pipes.dial(ip)
+			conn := accept(t, listener)
+			go func() { _, _ = io.Copy(io.Discard, client) }()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				if _, err := conn.Write(make([]byte, bandwidth)); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		return time.Since(start)
+	}
+
+	// the burst of each connection covers its data, but not the data of both
+	if elapsed := transfer(ConnLimits{ConnectionBandwidth: bandwidth}); elapsed > 500*time.Millisecond {
+		t.Errorf("connections should be shaped separately, took %s", elapsed)
+	}
+	if elapsed := transfer(ConnLimits{Bandwidth: bandwidth}); elapsed < 900*time.Millisecond {
+		t.Errorf("connections should share the bandwidth, took %s", elapsed)
+	}
+}
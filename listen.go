@@ -0,0 +1,106 @@
+package wireproxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// listen listens on `bindAddress`, which is either a TCP address or unix:/path, or uses the
+// socket named `systemdSocket` passed by systemd socket activation when set. Every call returns
+// a new listener, so that a routine can be restarted after closing its listener.
+func listen(bindAddress, systemdSocket string, perms SocketPermissions) (net.Listener, error) {
+	if systemdSocket != "" {
+		file, ok := inheritedSockets()[systemdSocket]
+		if !ok {
+			return nil, errors.New("no socket named " + systemdSocket + " was passed by systemd")
+		}
+		// FileListener duplicates the file descriptor, the inherited one stays open
+		return net.FileListener(file)
+	}
+
+	if path, ok := strings.CutPrefix(bindAddress, "unix:"); ok {
+		return listenUnix(path, perms)
+	}
+	return net.Listen("tcp", bindAddress)
+}
+
+// listenUnix listens on a unix socket at `path` with the permissions `perms`.
+// The socket is removed when the listener is closed.
+func listenUnix(path string, perms SocketPermissions) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	// bind in a private directory next to `path` and only move the socket into place once
+	// its permissions are set, so it is never reachable with the permissions of the umask
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".wireproxy-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	fail := func(err error) (net.Listener, error) {
+		_ = listener.Close()
+		return nil, err
+	}
+
+	if perms.SocketMode != 0 {
+		if err := os.Chmod(tmp, perms.SocketMode); err != nil {
+			return fail(err)
+		}
+	}
+	if perms.SocketOwner != "" {
+		if err := os.Chown(tmp, perms.SocketUID, perms.SocketGID); err != nil {
+			return fail(err)
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fail(err)
+	}
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// unixListener removes the socket at `path`, where it was moved after binding, once closed
+type unixListener struct {
+	*net.UnixListener
+	path   string
+	unlink sync.Once
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.unlink.Do(func() { _ = os.Remove(l.path) })
+	return err
+}
+
+// removeStaleSocket removes the socket left behind by a previous instance,
+// but refuses to take over one which is still in use or a file which is not a socket
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.New(path + " exists and is not a socket")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		_ = conn.Close()
+		return errors.New(path + " is already in use")
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,190 @@
+package wireproxy
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+const (
+	// minimum MTU every IPv4 and IPv6 link must support
+	minMTUv4 = 576
+	minMTUv6 = 1280
+	// mtuProbeInterval is how often the path MTU is probed again, as paths may change
+	mtuProbeInterval = 10 * time.Minute
+	mtuProbeTimeout  = time.Second
+	mtuProbeAttempts = 2
+)
+
+// mssClampTUN lowers the MSS option of TCP SYN packets in both directions,
+// so that TCP segments fit in the effective MTU of the tunnel
+type mssClampTUN struct {
+	tun.Device
+	// fixedMSS is the configured MSS, if 0 the MSS is derived from mtu
+	fixedMSS uint16
+	mtu      atomic.Int32
+}
+
+func newMSSClampTUN(dev tun.Device, fixedMSS uint16, mtu int) *mssClampTUN {
+	clamp := &mssClampTUN{Device: dev, fixedMSS: fixedMSS}
+	clamp.mtu.Store(int32(mtu))
+	return clamp
+}
+
+// SetMTU changes the MTU the MSS is derived from
+func (t *mssClampTUN) SetMTU(mtu int) {
+	t.mtu.Store(int32(mtu))
+}
+
+func (t *mssClampTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := t.Device.Read(bufs, sizes, offset)
+	for i := 0; i < n; i++ {
+		t.clamp(bufs[i][offset : offset+sizes[i]])
+	}
+	return n, err
+}
+
+func (t *mssClampTUN) Write(bufs [][]byte, offset int) (int, error) {
+	for _, buf := range bufs {
+		t.clamp(buf[offset:])
+	}
+	return t.Device.Write(bufs, offset)
+}
+
+// clamp rewrites the MSS option of a TCP SYN packet in place
+func (t *mssClampTUN) clamp(packet []byte) {
+	var segment []byte
+	var headerSize int
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		ihl := int(packet[0]&0x0f) * 4
+		fragmentOffset := binary.BigEndian.Uint16(packet[6:8]) & 0x1fff
+		if packet[9] != 6 || fragmentOffset != 0 || len(packet) < ihl {
+			return
+		}
+		segment = packet[ihl:]
+		headerSize = 20
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		if packet[6] != 6 {
+			return
+		}
+		segment = packet[40:]
+		headerSize = 40
+	default:
+		return
+	}
+
+	// only SYN packets carry the MSS option
+	if len(segment) < 20 || segment[13]&0x02 == 0 {
+		return
+	}
+
+	mss := t.fixedMSS
+	if mss == 0 {
+		mss = uint16(int(t.mtu.Load()) - headerSize - 20)
+	}
+
+	dataOffset := int(segment[12]>>4) * 4
+	if dataOffset < 20 || len(segment) < dataOffset {
+		return
+	}
+	options := segment[20:dataOffset]
+	for i := 0; i < len(options); {
+		kind := options[i]
+		if kind == 0 {
+			return
+		}
+		if kind == 1 {
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			return
+		}
+		length := int(options[i+1])
+		if kind == 2 && length == 4 {
+			current := binary.BigEndian.Uint16(options[i+2 : i+4])
+			if current > mss {
+				binary.BigEndian.PutUint16(options[i+2:i+4], mss)
+				updateChecksum(segment[16:18], current, mss)
+			}
+			return
+		}
+		i += length
+	}
+}
+
+// updateChecksum incrementally updates an internet checksum after
+// a 16 bit word changed from `old` to `new`, as described in RFC 1624
+func updateChecksum(checksum []byte, old, new uint16) {
+	sum := uint32(^binary.BigEndian.Uint16(checksum)) + uint32(^old) + uint32(new)
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	binary.BigEndian.PutUint16(checksum, ^uint16(sum))
+}
+
+// probeMTU finds the largest packet that makes it to `addr` and back through wireguard,
+// between the minimum MTU of the IP version and `maxMTU`
+func (d VirtualTun) probeMTU(addr netip.Addr, maxMTU int) (int, bool) {
+	// IP and ICMP headers
+	overhead := 20 + 8
+	low := minMTUv4
+	if addr.Is6() {
+		overhead = 40 + 8
+		low = minMTUv6
+	}
+
+	fits := func(mtu int) bool {
+		for i := 0; i < mtuProbeAttempts; i++ {
+			if d.ping(addr, mtu-overhead, mtuProbeTimeout) == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !fits(low) {
+		return 0, false
+	}
+
+	high := maxMTU
+	for low < high {
+		mid := (low + high + 1) / 2
+		if fits(mid) {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return low, true
+}
+
+// StartMTUDiscovery periodically probes the path MTU towards the first CheckAlive address,
+// and clamps the MSS of TCP connections accordingly. It does nothing unless MTU is set to auto.
+func (d VirtualTun) StartMTUDiscovery() {
+	if !d.Conf.MTUDiscovery || d.mssClamp == nil || len(d.Conf.CheckAlive) == 0 {
+		return
+	}
+
+	addr := d.Conf.CheckAlive[0]
+	go func() {
+		for {
+			mtu, ok := d.probeMTU(addr, d.Conf.MTU)
+			if ok {
+				d.Logger.Verbosef("Discovered MTU %d towards %s", mtu, addr)
+				d.mssClamp.SetMTU(mtu)
+			} else {
+				d.Logger.Errorf("Failed to discover MTU towards %s: no reply", addr)
+			}
+			select {
+			case <-d.done:
+				return
+			case <-time.After(mtuProbeInterval):
+			}
+		}
+	}()
+}
@@ -0,0 +1,135 @@
+package wireproxy
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// checksum returns the ones' complement sum of `data`
+func checksum(data ...[]byte) uint16 {
+	var sum uint32
+	for _, part := range data {
+		for i := 0; i+1 < len(part); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(part[i:]))
+		}
+		if len(part)%2 == 1 {
+			sum += uint32(part[len(part)-1]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return uint16(sum)
+}
+
+// tcpPacket builds an IPv4 or IPv6 packet of a TCP segment with `flags` and the MSS option `mss`
+func tcpPacket(src, dst netip.Addr, flags byte, mss uint16) []byte {
+	segment := make([]byte, 24)
+	binary.BigEndian.PutUint16(segment[0:], 40000)
+	binary.BigEndian.PutUint16(segment[2:], 443)
+	binary.BigEndian.PutUint32(segment[4:], 0x01020304)
+	segment[12] = 6 << 4
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:], 65535)
+	copy(segment[20:], []byte{2, 4, byte(mss >> 8), byte(mss)})
+
+	var header, pseudo []byte
+	if src.Is4() {
+		header = make([]byte, 20)
+		header[0] = 0x45
+		binary.BigEndian.PutUint16(header[2:], uint16(len(header)+len(segment)))
+		header[8], header[9] = 64, 6
+		copy(header[12:], src.AsSlice())
+		copy(header[16:], dst.AsSlice())
+		pseudo = append(append(src.AsSlice(), dst.AsSlice()...), 0, 6, 0, byte(len(segment)))
+	} else {
+		header = make([]byte, 40)
+		header[0] = 0x60
+		binary.BigEndian.PutUint16(header[4:], uint16(len(segment)))
+		header[6], header[7] = 6, 64
+		copy(header[8:], src.AsSlice())
+		copy(header[24:], dst.AsSlice())
+		pseudo = append(append(src.AsSlice(), dst.AsSlice()...), 0, 0, 0, byte(len(segment)), 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(segment[16:], ^checksum(pseudo, segment))
+	return append(header, segment...)
+}
+
+// tcpChecksumValid verifies the TCP checksum of `packet` built by tcpPacket
+func tcpChecksumValid(packet []byte) bool {
+	var pseudo, segment []byte
+	if packet[0]>>4 == 4 {
+		segment = packet[20:]
+		pseudo = append(append([]byte{}, packet[12:20]...), 0, 6, 0, byte(len(segment)))
+	} else {
+		segment = packet[40:]
+		pseudo = append(append([]byte{}, packet[8:40]...), 0, 0, 0, byte(len(segment)), 0, 0, 0, 6)
+	}
+	return checksum(pseudo, segment) == 0xffff
+}
+
+func TestUpdateChecksum(t *testing.T) {
+	// example from RFC 1624 section 4, where the result must be 0x0000 rather than 0xffff
+	sum := []byte{0xdd, 0x2f}
+	updateChecksum(sum, 0x5555, 0x3285)
+	if got := binary.BigEndian.Uint16(sum); got != 0x0000 {
+		t.Errorf("updateChecksum = %#04x, want 0x0000", got)
+	}
+
+	data := []byte{0x45, 0x00, 0x00, 0x3c, 0x1c, 0x46, 0x40, 0x00, 0x40, 0x06}
+	binary.BigEndian.PutUint16(sum, ^checksum(data))
+	updateChecksum(sum, binary.BigEndian.Uint16(data[2:]), 0x0578)
+	binary.BigEndian.PutUint16(data[2:], 0x0578)
+	if got, want := binary.BigEndian.Uint16(sum), ^checksum(data); got != want {
+		t.Errorf("updateChecksum = %#04x, want %#04x", got, want)
+	}
+}
+
+func TestMSSClamp(t *testing.T) {
+	v4src, v4dst := netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1")
+	v6src, v6dst := netip.MustParseAddr("fd00::2"), netip.MustParseAddr("fd00::1")
+	const syn, synAck, ack = 0x02, 0x12, 0x10
+
+	for _, test := range []struct {
+		name     string
+		packet   []byte
+		fixedMSS uint16
+		want     uint16
+	}{
+		// the MSS is derived from an MTU of 1420 minus the IP and TCP headers
+		{"IPv4 SYN", tcpPacket(v4src, v4dst, syn, 1460), 0, 1380},
+		{"IPv6 SYN", tcpPacket(v6src, v6dst, syn, 1440), 0, 1360},
+		{"SYN-ACK", tcpPacket(v4src, v4dst, synAck, 1460), 0, 1380},
+		{"fixed MSS", tcpPacket(v6src, v6dst, syn, 1440), 1200, 1200},
+		{"lower MSS", tcpPacket(v4src, v4dst, syn, 1300), 0, 1300},
+		{"not a SYN", tcpPacket(v4src, v4dst, ack, 1460), 0, 1460},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			newMSSClampTUN(nil, test.fixedMSS, 1420).clamp(test.packet)
+
+			headerSize := 20
+			if test.packet[0]>>4 == 6 {
+				headerSize = 40
+			}
+			if mss := binary.BigEndian.Uint16(test.packet[headerSize+22:]); mss != test.want {
+				t.Errorf("MSS = %d, want %d", mss, test.want)
+			}
+			if !tcpChecksumValid(test.packet) {
+				t.Error("invalid TCP checksum after clamping")
+			}
+		})
+	}
+
+	// fragments and truncated options are left alone
+	fragment := tcpPacket(v4src, v4dst, syn, 1460)
+	binary.BigEndian.PutUint16(fragment[6:], 1)
+	truncated := tcpPacket(v4src, v4dst, syn, 1460)[:42]
+	for _, packet := range [][]byte{fragment, truncated} {
+		before := string(packet)
+		newMSSClampTUN(nil, 0, 1420).clamp(packet)
+		if string(packet) != before {
+			t.Errorf("unexpected rewrite of %x", packet)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/pufferffish/wireproxy/internal/netstack"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// applyNetstackConfig sets the TCP options of `s` according to `conf`
+func applyNetstackConfig(s *stack.Stack, conf *NetstackConfig) error {
+	if conf.CongestionControl != "" {
+		opt := tcpip.CongestionControlOption(conf.CongestionControl)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("could not set congestion control to %s: %s", conf.CongestionControl, err)
+		}
+	}
+
+	if conf.SACK != nil {
+		opt := tcpip.TCPSACKEnabled(*conf.SACK)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("could not set TCP SACK: %s", err)
+		}
+	}
+
+	if conf.ModerateReceiveBuffer != nil {
+		opt := tcpip.TCPModerateReceiveBufferOption(*conf.ModerateReceiveBuffer)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("could not set receive buffer moderation: %s", err)
+		}
+	}
+
+	if conf.ReceiveBufferMax > 0 {
+		var opt tcpip.TCPReceiveBufferSizeRangeOption
+		if err := s.TransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("could not get receive buffer size: %s", err)
+		}
+		opt.Max = conf.ReceiveBufferMax
+		opt.Default = min(opt.Default, opt.Max)
+		opt.Min = min(opt.Min, opt.Default)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("could not set receive buffer size: %s", err)
+		}
+	}
+
+	if conf.SendBufferMax > 0 {
+		var opt tcpip.TCPSendBufferSizeRangeOption
+		if err := s.TransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("could not get send buffer size: %s", err)
+		}
+		opt.Max = conf.SendBufferMax
+		opt.Default = min(opt.Default, opt.Max)
+		opt.Min = min(opt.Min, opt.Default)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("could not set send buffer size: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// forwardBufferSize returns the size of the buffers copying data between forwarded connections
+func (d VirtualTun) forwardBufferSize() int {
+	if d.Conf.Netstack != nil && d.Conf.Netstack.ForwardBufferSize > 0 {
+		return d.Conf.Netstack.ForwardBufferSize
+	}
+	return defaultForwardBufferSize
+}
+
+// DialContextTCPAddrPort connects to `addr` via wireguard, applying the TCP keepalive from [Netstack]
+func (d VirtualTun) DialContextTCPAddrPort(ctx context.Context, addr netip.AddrPort) (*gonet.TCPConn, error) {
+	conf := d.Conf.Netstack
+	if d.stack == nil || conf == nil || conf.KeepAlive == 0 {
+		return d.Tnet.DialContextTCPAddrPort(ctx, addr)
+	}
+
+	network := ipv6.ProtocolNumber
+	if addr.Addr().Is4() {
+		network = ipv4.ProtocolNumber
+	}
+	remote := tcpip.FullAddress{
+		NIC:  netstack.NICID,
+		Addr: tcpip.AddrFromSlice(addr.Addr().AsSlice()),
+		Port: addr.Port(),
+	}
+
+	var wq waiter.Queue
+	ep, tcpipErr := d.stack.NewEndpoint(tcp.ProtocolNumber, network, &wq)
+	if tcpipErr != nil {
+		return nil, errors.New(tcpipErr.String())
+	}
+
+	ep.SocketOptions().SetKeepAlive(true)
+	idle := tcpip.KeepaliveIdleOption(time.Duration(conf.KeepAlive) * time.Second)
+	interval := tcpip.KeepaliveIntervalOption(time.Duration(conf.KeepAliveInterval) * time.Second)
+	if tcpipErr := ep.SetSockOpt(&idle); tcpipErr != nil {
+		ep.Close()
+		return nil, errors.New(tcpipErr.String())
+	}
+	if tcpipErr := ep.SetSockOpt(&interval); tcpipErr != nil {
+		ep.Close()
+		return nil, errors.New(tcpipErr.String())
+	}
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+
+	tcpipErr = ep.Connect(remote)
+	if _, ok := tcpipErr.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			ep.Close()
+			return nil, ctx.Err()
+		case <-notifyCh:
+		}
+		tcpipErr = ep.LastError()
+	}
+	if tcpipErr != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "connect",
+			Net:  "tcp",
+			Addr: TCPAddrFromAddrPort(addr),
+			Err:  errors.New(tcpipErr.String()),
+		}
+	}
+
+	return gonet.NewTCPConn(&wq, ep), nil
+}
+
+// DialContext connects to `address` via wireguard. TCP connections get the
+// TCP keepalive from [Netstack], other networks are handled by netstack as is.
+func (d VirtualTun) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return d.Tnet.DialContext(ctx, network, address)
+	}
+
+	target, err := parseAddressPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(target.address); err == nil {
+		addrs = append(addrs, addr)
+	} else {
+		names, err := d.Tnet.LookupContextHost(ctx, target.address)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Err: err}
+		}
+		for _, name := range names {
+			if addr, err := netip.ParseAddr(name); err == nil {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	var lastErr error = &net.OpError{Op: "dial", Err: errors.New("no address found for: " + address)}
+	for _, addr := range addrs {
+		if (network == "tcp4" && !addr.Is4()) || (network == "tcp6" && !addr.Is6()) {
+			continue
+		}
+		conn, err := d.DialContextTCPAddrPort(ctx, netip.AddrPortFrom(addr, target.port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Dial connects to `address` via wireguard, see DialContext
+func (d VirtualTun) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
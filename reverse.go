@@ -0,0 +1,146 @@
+package wireproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/bufferpool"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// allows checks whether connections may go to `addr`
+func (acl DestinationACL) allows(addr netip.AddrPort) bool {
+	if len(acl.AllowedPorts) > 0 && !slices.Contains(acl.AllowedPorts, addr.Port()) {
+		return false
+	}
+	for _, prefix := range acl.AllowedIPs {
+		if prefix.Contains(addr.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// dial connects to `address` on the local network, trying every address it resolves
+// to which is allowed by the ACL
+func (acl DestinationACL) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s: %w", portStr, err)
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	err = fmt.Errorf("destination %s is not allowed", address)
+	for _, addr := range addrs {
+		target := netip.AddrPortFrom(addr.Unmap(), uint16(port))
+		if !acl.allows(target) {
+			continue
+		}
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, target.String())
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// aclRule only lets socks5 clients connect, to the destinations allowed by an ACL
+type aclRule struct {
+	acl DestinationACL
+}
+
+func (r aclRule) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != statute.CommandConnect {
+		return ctx, false
+	}
+	addr, ok := netip.AddrFromSlice(req.DestAddr.IP)
+	return ctx, ok && r.acl.allows(netip.AddrPortFrom(addr, uint16(req.DestAddr.Port)))
+}
+
+// SpawnRoutine spawns a socks5 server on wireguard, which connects to the local network
+func (config *Socks5ServerConfig) SpawnRoutine(ctx context.Context, vt *VirtualTun) error {
+	var authMethods []socks5.Authenticator
+	if username := config.Username; username != "" {
+		authMethods = append(authMethods, socks5.UserPassAuthenticator{
+			Credentials: socks5.StaticCredentials{username: config.Password},
+		})
+	} else {
+		authMethods = append(authMethods, socks5.NoAuthAuthenticator{})
+	}
+
+	proxy := &Socks5Config{
+		Username:     config.Username,
+		Password:     config.Password,
+		ConnTimeouts: config.ConnTimeouts,
+		Quota:        config.Quota,
+	}
+	options := []socks5.Option{
+		socks5.WithRule(aclRule{config.DestinationACL}),
+		socks5.WithAuthMethods(authMethods),
+		socks5.WithBufferPool(bufferpool.NewPool(256 * 1024)),
+		socks5.WithLogger(socks5Logger{vt.Logger}),
+		socks5.WithConnectHandle(func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+			return socks5Connect(ctx, vt, config.DestinationACL.dial, writer, request, proxy)
+		}),
+	}
+
+	server := socks5.NewServer(options...)
+
+	listener, err := vt.Tnet.ListenTCP(&net.TCPAddr{Port: config.ListenPort})
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stop()
+
+	err = server.Serve(trackConnections(ctx, newLimitedListener(retryListener{listener, vt.Logger}, config.ConnLimits, rejectSocks5, vt.Logger)))
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// SpawnRoutine spawns a http proxy on wireguard, which connects to the local network
+func (config *HTTPServerConfig) SpawnRoutine(ctx context.Context, vt *VirtualTun) error {
+	server := &HTTPServer{
+		config: &HTTPConfig{
+			Username:     config.Username,
+			Password:     config.Password,
+			ConnTimeouts: config.ConnTimeouts,
+			ConnLimits:   config.ConnLimits,
+			Quota:        config.Quota,
+		},
+		dial: func(network, address string) (net.Conn, error) {
+			return config.DestinationACL.dial(ctx, network, address)
+		},
+		accounting: vt.Accounting,
+		logger:     vt.Logger,
+		bufferSize: vt.forwardBufferSize(),
+		auth:       CredentialValidator{config.Username, config.Password},
+	}
+	if config.Username != "" || config.Password != "" {
+		server.authRequired = true
+	}
+
+	listener, err := vt.Tnet.ListenTCP(&net.TCPAddr{Port: config.ListenPort})
+	if err != nil {
+		return fmt.Errorf("listen tcp failed: %w", err)
+	}
+	return server.Serve(ctx, listener)
+}
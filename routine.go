@@ -8,12 +8,12 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 	"golang.zx2c4.com/wireguard/device"
 	"io"
-	"log"
 	"math/rand"
 	"net"
 	"net/http"
@@ -26,15 +26,14 @@ import (
 
 	"github.com/things-go/go-socks5"
 	"github.com/things-go/go-socks5/bufferpool"
+	"github.com/things-go/go-socks5/statute"
 
 	"net/netip"
 
-	"golang.zx2c4.com/wireguard/tun/netstack"
+	"github.com/pufferffish/wireproxy/internal/netstack"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
-// errorLogger is the logger to print error message
-var errorLogger = log.New(os.Stderr, "ERROR: ", log.LstdFlags)
-
 // CredentialValidator stores the authentication data of a socks5 proxy
 type CredentialValidator struct {
 	username string
@@ -47,14 +46,31 @@ type VirtualTun struct {
 	Dev       *device.Device
 	SystemDNS bool
 	Conf      *DeviceConfig
+	// Logger receives the messages of wireguard and of the routines
+	Logger *device.Logger
 	// PingRecord stores the last time an IP was pinged
 	PingRecord     map[string]uint64
 	PingRecordLock *sync.Mutex
+	// Capture taps the packets going through wireguard
+	Capture *PacketCapture
+	// Accounting counts the traffic of authenticated users
+	Accounting *Accounting
+	// Routines supervises the routines spawned on this tunnel
+	Routines *Supervisor
+	// config is the configuration of the tunnel and of its routines, if known
+	config *Configuration
+	// mssClamp is set when the MSS of TCP connections is clamped
+	mssClamp *mssClampTUN
+	// stack is set when netstack is tuned by [Netstack]
+	stack *stack.Stack
+	// done is closed once the tunnel is closed, stopping its background tasks
+	done chan struct{}
 }
 
 // RoutineSpawner spawns a routine (e.g. socks5, tcp static routes) after the configuration is parsed
 type RoutineSpawner interface {
-	SpawnRoutine(vt *VirtualTun)
+	// SpawnRoutine runs the routine until it fails, its work is done, or `ctx` is done
+	SpawnRoutine(ctx context.Context, vt *VirtualTun) error
 }
 
 type addressPort struct {
@@ -138,8 +154,75 @@ func (d VirtualTun) resolveToAddrPort(endpoint *addressPort) (*netip.AddrPort, e
 	return &addrPort, nil
 }
 
+// socks5Connect handles a socks5 CONNECT request by dialing the target with `dial`
+func socks5Connect(ctx context.Context, vt *VirtualTun, dial func(ctx context.Context, network, address string) (net.Conn, error), writer io.Writer, request *socks5.Request, config *Socks5Config) error {
+	conn, ok := writer.(net.Conn)
+	if !ok {
+		return errors.New("socks5 client is not a connection")
+	}
+
+	var username string
+	if request.AuthContext != nil {
+		username = request.AuthContext.Payload["username"]
+	}
+	if username != "" && vt.Accounting.Exceeded(username, config.Quota) {
+		if err := socks5.SendReply(writer, statute.RepRuleFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("quota of %s exceeded", username)
+	}
+
+	target, err := dial(ctx, "tcp", request.DestAddr.String())
+	if err != nil {
+		reply := statute.RepHostUnreachable
+		if msg := err.Error(); strings.Contains(msg, "refused") {
+			reply = statute.RepConnectionRefused
+		} else if strings.Contains(msg, "network is unreachable") {
+			reply = statute.RepNetworkUnreachable
+		}
+		if err := socks5.SendReply(writer, reply, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("connect to %v failed: %w", request.RawDestAddr, err)
+	}
+
+	if err := socks5.SendReply(writer, statute.RepSuccess, target.LocalAddr()); err != nil {
+		_ = target.Close()
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+
+	client := vt.Accounting.account(&readerConn{Reader: request.Reader, Conn: conn}, username)
+	connForward(client, target, vt.forwardBufferSize(), config.ConnTimeouts, vt.Logger)
+	return nil
+}
+
+// rejectSocks5 answers the greeting of a socks5 client over the connection limits
+// with "no acceptable methods", which makes the client give up
+func rejectSocks5(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(rejectTimeout))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != statute.VersionSocks5 {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+	_, _ = conn.Write([]byte{statute.VersionSocks5, statute.MethodNoAcceptable})
+}
+
+// socks5Logger passes the errors of the socks5 server to a wireguard logger
+type socks5Logger struct {
+	logger *device.Logger
+}
+
+func (l socks5Logger) Errorf(format string, args ...interface{}) {
+	l.logger.Errorf(format, args...)
+}
+
 // SpawnRoutine spawns a socks5 server.
-func (config *Socks5Config) SpawnRoutine(vt *VirtualTun) {
+func (config *Socks5Config) SpawnRoutine(ctx context.Context, vt *VirtualTun) error {
 	var authMethods []socks5.Authenticator
 	if username := config.Username; username != "" {
 		authMethods = append(authMethods, socks5.UserPassAuthenticator{
@@ -150,33 +233,52 @@ func (config *Socks5Config) SpawnRoutine(vt *VirtualTun) {
 	}
 
 	options := []socks5.Option{
-		socks5.WithDial(vt.Tnet.DialContext),
+		socks5.WithDial(vt.DialContext),
 		socks5.WithResolver(vt),
 		socks5.WithAuthMethods(authMethods),
 		socks5.WithBufferPool(bufferpool.NewPool(256 * 1024)),
+		socks5.WithLogger(socks5Logger{vt.Logger}),
+		socks5.WithConnectHandle(func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+			return socks5Connect(ctx, vt, vt.DialContext, writer, request, config)
+		}),
 	}
 
 	server := socks5.NewServer(options...)
 
-	if err := server.ListenAndServe("tcp", config.BindAddress); err != nil {
-		log.Fatal(err)
+	listener, err := listen(config.BindAddress, config.SystemdSocket, config.SocketPermissions)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stop()
+
+	err = server.Serve(trackConnections(ctx, newLimitedListener(retryListener{listener, vt.Logger}, config.ConnLimits, rejectSocks5, vt.Logger)))
+	if ctx.Err() != nil {
+		return nil
 	}
+	return err
 }
 
 // SpawnRoutine spawns a http server.
-func (config *HTTPConfig) SpawnRoutine(vt *VirtualTun) {
+func (config *HTTPConfig) SpawnRoutine(ctx context.Context, vt *VirtualTun) error {
 	server := &HTTPServer{
-		config: config,
-		dial:   vt.Tnet.Dial,
-		auth:   CredentialValidator{config.Username, config.Password},
+		config:     config,
+		dial:       vt.Dial,
+		accounting: vt.Accounting,
+		logger:     vt.Logger,
+		bufferSize: vt.forwardBufferSize(),
+		auth:       CredentialValidator{config.Username, config.Password},
 	}
 	if config.Username != "" || config.Password != "" {
 		server.authRequired = true
 	}
 
-	if err := server.ListenAndServe("tcp", config.BindAddress); err != nil {
-		log.Fatal(err)
+	listener, err := listen(config.BindAddress, config.SystemdSocket, config.SocketPermissions)
+	if err != nil {
+		return fmt.Errorf("listen tcp failed: %w", err)
 	}
+	return server.Serve(ctx, listener)
 }
 
 // Valid checks the authentication data in CredentialValidator and compare them
@@ -187,156 +289,181 @@ func (c CredentialValidator) Valid(username, password string) bool {
 	return u&p == 1
 }
 
-// connForward copy data from `from` to `to`
-func connForward(from io.ReadWriteCloser, to io.ReadWriteCloser) {
-	defer from.Close()
-	defer to.Close()
-
-	_, err := io.Copy(to, from)
+// tcpClientForward starts a new connection via wireguard to a target picked by `targets`
+// and forward traffic from `conn`
+func tcpClientForward(vt *VirtualTun, targets *balancer, conn net.Conn, timeouts ConnTimeouts) {
+	sconn, release, err := targets.connect(context.Background())
 	if err != nil {
-		errorLogger.Printf("Cannot forward traffic: %s\n", err.Error())
+		vt.Logger.Errorf("TCP Client Tunnel: %s", err.Error())
+		_ = conn.Close()
+		return
 	}
+	defer release()
+
+	connForward(conn, sconn, vt.forwardBufferSize(), timeouts, vt.Logger)
 }
 
-// tcpClientForward starts a new connection via wireguard and forward traffic from `conn`
-func tcpClientForward(vt *VirtualTun, raddr *addressPort, conn net.Conn) {
-	target, err := vt.resolveToAddrPort(raddr)
+// dialTunnel connects to `raddr` via wireguard
+func (d VirtualTun) dialTunnel(ctx context.Context, raddr *addressPort) (net.Conn, error) {
+	target, err := d.resolveToAddrPort(raddr)
 	if err != nil {
-		errorLogger.Printf("TCP Server Tunnel to %s: %s\n", target, err.Error())
-		return
+		return nil, fmt.Errorf("%s: %w", raddr.address, err)
 	}
 
-	tcpAddr := TCPAddrFromAddrPort(*target)
-
-	sconn, err := vt.Tnet.DialTCP(tcpAddr)
+	// a nil *gonet.TCPConn must not be returned as a non-nil net.Conn
+	conn, err := d.DialContextTCPAddrPort(ctx, *target)
 	if err != nil {
-		errorLogger.Printf("TCP Client Tunnel to %s: %s\n", target, err.Error())
-		return
+		return nil, err
 	}
-
-	go connForward(sconn, conn)
-	go connForward(conn, sconn)
+	return conn, nil
 }
 
 // STDIOTcpForward starts a new connection via wireguard and forward traffic from `conn`
-func STDIOTcpForward(vt *VirtualTun, raddr *addressPort) {
+func STDIOTcpForward(vt *VirtualTun, raddr *addressPort, timeouts ConnTimeouts) error {
 	target, err := vt.resolveToAddrPort(raddr)
 	if err != nil {
-		errorLogger.Printf("Name resolution error for %s: %s\n", raddr.address, err.Error())
-		return
+		return fmt.Errorf("name resolution error for %s: %w", raddr.address, err)
 	}
 
-	// os.Stdout has previously been remapped to stderr, se we can't use it
-	stdout, err := os.OpenFile("/dev/stdout", os.O_WRONLY, 0)
+	sconn, err := vt.DialContextTCPAddrPort(context.Background(), *target)
 	if err != nil {
-		errorLogger.Printf("Failed to open /dev/stdout: %s\n", err.Error())
-		return
-	}
-
-	tcpAddr := TCPAddrFromAddrPort(*target)
-	sconn, err := vt.Tnet.DialTCP(tcpAddr)
-	if err != nil {
-		errorLogger.Printf("TCP Client Tunnel to %s (%s): %s\n", target, tcpAddr, err.Error())
-		return
+		return fmt.Errorf("TCP Client Tunnel to %s: %w", target, err)
 	}
 
-	go connForward(os.Stdin, sconn)
-	go connForward(sconn, stdout)
+	connForward(&stdioConn{in: os.Stdin, out: initialStdout}, sconn, vt.forwardBufferSize(), timeouts, vt.Logger)
+	return nil
 }
 
 // SpawnRoutine spawns a local TCP server which acts as a proxy to the specified target
-func (conf *TCPClientTunnelConfig) SpawnRoutine(vt *VirtualTun) {
-	raddr, err := parseAddressPort(conf.Target)
+func (conf *TCPClientTunnelConfig) SpawnRoutine(ctx context.Context, vt *VirtualTun) error {
+	targets, err := newBalancer(conf.Target, conf.LoadBalancing, vt.dialTunnel)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if conf.HealthCheckInterval > 0 {
+		go targets.checkHealth(ctx, time.Duration(conf.HealthCheckInterval)*time.Second, vt.Logger)
 	}
 
-	server, err := net.ListenTCP("tcp", conf.BindAddress)
+	listener, err := listen(conf.bindAddress(), conf.SystemdSocket, conf.SocketPermissions)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stop()
+	server := trackConnections(ctx, newLimitedListener(retryListener{listener, vt.Logger}, conf.ConnLimits, closeConn, vt.Logger))
 
 	for {
 		conn, err := server.Accept()
+		if ctx.Err() != nil {
+			return nil
+		}
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		go tcpClientForward(vt, raddr, conn)
+		go tcpClientForward(vt, targets, conn, conf.ConnTimeouts)
 	}
 }
 
 // SpawnRoutine connects to the specified target and plumbs it to STDIN / STDOUT
-func (conf *STDIOTunnelConfig) SpawnRoutine(vt *VirtualTun) {
+func (conf *STDIOTunnelConfig) SpawnRoutine(_ context.Context, vt *VirtualTun) error {
 	raddr, err := parseAddressPort(conf.Target)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	go STDIOTcpForward(vt, raddr)
+	return STDIOTcpForward(vt, raddr, conf.ConnTimeouts)
 }
 
-// tcpServerForward starts a new connection locally and forward traffic from `conn`
-func tcpServerForward(vt *VirtualTun, raddr *addressPort, conn net.Conn) {
-	target, err := vt.resolveToAddrPort(raddr)
+// tcpServerForward starts a new connection locally to a target picked by `targets`
+// and forward traffic from `conn`
+func tcpServerForward(vt *VirtualTun, targets *balancer, conn net.Conn, timeouts ConnTimeouts) {
+	sconn, release, err := targets.connect(context.Background())
 	if err != nil {
-		errorLogger.Printf("TCP Server Tunnel to %s: %s\n", target, err.Error())
+		vt.Logger.Errorf("TCP Server Tunnel: %s", err.Error())
+		_ = conn.Close()
 		return
 	}
+	defer release()
 
-	tcpAddr := TCPAddrFromAddrPort(*target)
+	connForward(conn, sconn, vt.forwardBufferSize(), timeouts, vt.Logger)
+}
 
-	sconn, err := net.DialTCP("tcp", nil, tcpAddr)
+// dialLocal connects to `raddr` on the local network
+func (d VirtualTun) dialLocal(ctx context.Context, raddr *addressPort) (net.Conn, error) {
+	target, err := d.resolveToAddrPort(raddr)
 	if err != nil {
-		errorLogger.Printf("TCP Server Tunnel to %s: %s\n", target, err.Error())
-		return
+		return nil, fmt.Errorf("%s: %w", raddr.address, err)
 	}
 
-	go connForward(sconn, conn)
-	go connForward(conn, sconn)
-
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", TCPAddrFromAddrPort(*target).String())
 }
 
 // SpawnRoutine spawns a TCP server on wireguard which acts as a proxy to the specified target
-func (conf *TCPServerTunnelConfig) SpawnRoutine(vt *VirtualTun) {
-	raddr, err := parseAddressPort(conf.Target)
+func (conf *TCPServerTunnelConfig) SpawnRoutine(ctx context.Context, vt *VirtualTun) error {
+	targets, err := newBalancer(conf.Target, conf.LoadBalancing, vt.dialLocal)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if conf.HealthCheckInterval > 0 {
+		go targets.checkHealth(ctx, time.Duration(conf.HealthCheckInterval)*time.Second, vt.Logger)
 	}
 
 	addr := &net.TCPAddr{Port: conf.ListenPort}
-	server, err := vt.Tnet.ListenTCP(addr)
+	listener, err := vt.Tnet.ListenTCP(addr)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stop()
+	server := trackConnections(ctx, newLimitedListener(retryListener{listener, vt.Logger}, conf.ConnLimits, closeConn, vt.Logger))
 
 	for {
 		conn, err := server.Accept()
+		if ctx.Err() != nil {
+			return nil
+		}
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		go tcpServerForward(vt, raddr, conn)
+		go tcpServerForward(vt, targets, conn, conf.ConnTimeouts)
 	}
 }
 
+// Ready checks whether every CheckAlive address answered recently and no routine failed, as /readyz reports
+func (d VirtualTun) Ready() bool {
+	d.PingRecordLock.Lock()
+	defer d.PingRecordLock.Unlock()
+	for _, record := range d.PingRecord {
+		lastPong := time.Unix(int64(record), 0)
+		// +2 seconds to account for the time it takes to ping the IP
+		if time.Since(lastPong) > time.Duration(d.Conf.CheckAliveInterval+2)*time.Second {
+			return false
+		}
+	}
+	return d.Routines.Healthy()
+}
+
 func (d VirtualTun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Health metric request: %s\n", r.URL.Path)
+	d.Logger.Verbosef("Health metric request: %s", r.URL.Path)
 	switch path.Clean(r.URL.Path) {
 	case "/readyz":
 		body, err := json.Marshal(d.PingRecord)
 		if err != nil {
-			errorLogger.Printf("Failed to get device metrics: %s\n", err.Error())
+			d.Logger.Errorf("Failed to get device metrics: %s", err.Error())
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
 		status := http.StatusOK
-		for _, record := range d.PingRecord {
-			lastPong := time.Unix(int64(record), 0)
-			// +2 seconds to account for the time it takes to ping the IP
-			if time.Since(lastPong) > time.Duration(d.Conf.CheckAliveInterval+2)*time.Second {
-				status = http.StatusServiceUnavailable
-				break
-			}
+		if !d.Ready() {
+			status = http.StatusServiceUnavailable
 		}
 
 		w.WriteHeader(status)
@@ -345,7 +472,7 @@ func (d VirtualTun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "/metrics":
 		get, err := d.Dev.IpcGet()
 		if err != nil {
-			errorLogger.Printf("Failed to get device metrics: %s\n", err.Error())
+			d.Logger.Errorf("Failed to get device metrics: %s", err.Error())
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -367,90 +494,110 @@ func (d VirtualTun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write(buf.Bytes())
+	case "/capture":
+		if d.Conf.Capture == nil || !d.Conf.Capture.Stream {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		d.Capture.ServeHTTP(w, r)
+	case "/usage":
+		d.Accounting.ServeHTTP(w, r)
+	case "/routines":
+		d.Routines.ServeHTTP(w, r)
+	case "/status":
+		d.serveStatus(w)
+	case "/config":
+		conf := d.config
+		if conf == nil {
+			conf = &Configuration{Device: d.Conf}
+		}
+		serveConfig(w, r, conf)
 	default:
 		w.WriteHeader(http.StatusNotFound)
 	}
 }
 
-func (d VirtualTun) pingIPs() {
-	for _, addr := range d.Conf.CheckAlive {
-		socket, err := d.Tnet.Dial("ping", addr.String())
-		if err != nil {
-			errorLogger.Printf("Failed to ping %s: %s\n", addr, err.Error())
-			continue
-		}
+// ping sends an ICMP echo request carrying `size` bytes of data to `addr` via wireguard,
+// and waits up to `timeout` for the matching reply
+func (d VirtualTun) ping(addr netip.Addr, size int, timeout time.Duration) error {
+	socket, err := d.Tnet.Dial("ping", addr.String())
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+
+	data := make([]byte, size)
+	_, _ = srand.Read(data)
 
-		data := make([]byte, 16)
-		_, _ = srand.Read(data)
+	requestPing := icmp.Echo{
+		Seq:  rand.Intn(1 << 16),
+		Data: data,
+	}
+
+	var icmpBytes []byte
+	if addr.Is4() {
+		icmpBytes, _ = (&icmp.Message{Type: ipv4.ICMPTypeEcho, Code: 0, Body: &requestPing}).Marshal(nil)
+	} else if addr.Is6() {
+		icmpBytes, _ = (&icmp.Message{Type: ipv6.ICMPTypeEchoRequest, Code: 0, Body: &requestPing}).Marshal(nil)
+	} else {
+		return errors.New("invalid address: " + addr.String())
+	}
+
+	_ = socket.SetReadDeadline(time.Now().Add(timeout))
+	_, err = socket.Write(icmpBytes)
+	if err != nil {
+		return err
+	}
 
-		requestPing := icmp.Echo{
-			Seq:  rand.Intn(1 << 16),
-			Data: data,
+	n, err := socket.Read(icmpBytes[:])
+	if err != nil {
+		return fmt.Errorf("failed to read ping response: %w", err)
+	}
+
+	replyPacket, err := icmp.ParseMessage(1, icmpBytes[:n])
+	if err != nil {
+		return fmt.Errorf("failed to parse ping response: %w", err)
+	}
+
+	if addr.Is4() {
+		replyPing, ok := replyPacket.Body.(*icmp.Echo)
+		if !ok {
+			return fmt.Errorf("failed to parse ping response: invalid reply type: %s", replyPacket.Type)
+		}
+		if !bytes.Equal(replyPing.Data, requestPing.Data) || replyPing.Seq != requestPing.Seq {
+			return fmt.Errorf("failed to parse ping response: invalid ping reply: %v", replyPing)
 		}
+	}
 
-		var icmpBytes []byte
-		if addr.Is4() {
-			icmpBytes, _ = (&icmp.Message{Type: ipv4.ICMPTypeEcho, Code: 0, Body: &requestPing}).Marshal(nil)
-		} else if addr.Is6() {
-			icmpBytes, _ = (&icmp.Message{Type: ipv6.ICMPTypeEchoRequest, Code: 0, Body: &requestPing}).Marshal(nil)
-		} else {
-			errorLogger.Printf("Failed to ping %s: invalid address: %s\n", addr, addr.String())
-			continue
+	if addr.Is6() {
+		replyPing, ok := replyPacket.Body.(*icmp.RawBody)
+		if !ok {
+			return fmt.Errorf("failed to parse ping response: invalid reply type: %s", replyPacket.Type)
 		}
 
-		_ = socket.SetReadDeadline(time.Now().Add(time.Duration(d.Conf.CheckAliveInterval) * time.Second))
-		_, err = socket.Write(icmpBytes)
-		if err != nil {
-			errorLogger.Printf("Failed to ping %s: %s\n", addr, err.Error())
-			continue
+		seq := binary.BigEndian.Uint16(replyPing.Data[2:4])
+		pongBody := replyPing.Data[4:]
+		if !bytes.Equal(pongBody, requestPing.Data) || int(seq) != requestPing.Seq {
+			return fmt.Errorf("failed to parse ping response: invalid ping reply: %v", replyPing)
 		}
+	}
 
+	return nil
+}
+
+func (d VirtualTun) pingIPs() {
+	for _, addr := range d.Conf.CheckAlive {
 		addr := addr
 		go func() {
-			n, err := socket.Read(icmpBytes[:])
-			if err != nil {
-				errorLogger.Printf("Failed to read ping response from %s: %s\n", addr, err.Error())
-				return
-			}
-
-			replyPacket, err := icmp.ParseMessage(1, icmpBytes[:n])
+			err := d.ping(addr, 16, time.Duration(d.Conf.CheckAliveInterval)*time.Second)
 			if err != nil {
-				errorLogger.Printf("Failed to parse ping response from %s: %s\n", addr, err.Error())
+				d.Logger.Errorf("Failed to ping %s: %s", addr, err.Error())
 				return
 			}
 
-			if addr.Is4() {
-				replyPing, ok := replyPacket.Body.(*icmp.Echo)
-				if !ok {
-					errorLogger.Printf("Failed to parse ping response from %s: invalid reply type: %s\n", addr, replyPacket.Type)
-					return
-				}
-				if !bytes.Equal(replyPing.Data, requestPing.Data) || replyPing.Seq != requestPing.Seq {
-					errorLogger.Printf("Failed to parse ping response from %s: invalid ping reply: %v\n", addr, replyPing)
-					return
-				}
-			}
-
-			if addr.Is6() {
-				replyPing, ok := replyPacket.Body.(*icmp.RawBody)
-				if !ok {
-					errorLogger.Printf("Failed to parse ping response from %s: invalid reply type: %s\n", addr, replyPacket.Type)
-					return
-				}
-
-				seq := binary.BigEndian.Uint16(replyPing.Data[2:4])
-				pongBody := replyPing.Data[4:]
-				if !bytes.Equal(pongBody, requestPing.Data) || int(seq) != requestPing.Seq {
-					errorLogger.Printf("Failed to parse ping response from %s: invalid ping reply: %v\n", addr, replyPing)
-					return
-				}
-			}
-
 			d.PingRecordLock.Lock()
 			d.PingRecord[addr.String()] = uint64(time.Now().Unix())
 			d.PingRecordLock.Unlock()
-
-			defer socket.Close()
 		}()
 	}
 }
@@ -461,9 +608,15 @@ func (d VirtualTun) StartPingIPs() {
 	}
 
 	go func() {
+		ticker := time.NewTicker(time.Duration(d.Conf.CheckAliveInterval) * time.Second)
+		defer ticker.Stop()
 		for {
 			d.pingIPs()
-			time.Sleep(time.Duration(d.Conf.CheckAliveInterval) * time.Second)
+			select {
+			case <-d.done:
+				return
+			case <-ticker.C:
+			}
 		}
 	}()
 }
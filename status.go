@@ -0,0 +1,120 @@
+package wireproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status describes the wireguard device and the routines of a running instance
+type Status struct {
+	PublicKey  string         `json:"public_key"`
+	ListenPort int            `json:"listen_port,omitempty"`
+	Peers      []PeerStatus   `json:"peers"`
+	Routines   []RoutineState `json:"routines"`
+}
+
+// PeerStatus describes a wireguard peer, as shown by wg show
+type PeerStatus struct {
+	PublicKey           string     `json:"public_key"`
+	Endpoint            string     `json:"endpoint,omitempty"`
+	AllowedIPs          []string   `json:"allowed_ips"`
+	LatestHandshake     *time.Time `json:"latest_handshake,omitempty"`
+	ReceivedBytes       int64      `json:"received_bytes"`
+	SentBytes           int64      `json:"sent_bytes"`
+	PersistentKeepalive int        `json:"persistent_keepalive,omitempty"`
+}
+
+// Status returns the current status of the tunnel
+func (d VirtualTun) Status() (*Status, error) {
+	ipc, err := d.Dev.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	status := parseIpcStatus(ipc)
+	status.Routines = d.Routines.States()
+	return status, nil
+}
+
+// parseIpcStatus parses the response of a UAPI get operation
+func parseIpcStatus(ipc string) *Status {
+	status := &Status{Peers: []PeerStatus{}}
+	var peer *PeerStatus
+	var handshakeSec, handshakeNsec int64
+
+	// the latest handshake is split across two keys, it is complete once the next peer starts
+	finishPeer := func() {
+		if peer != nil && (handshakeSec != 0 || handshakeNsec != 0) {
+			handshake := time.Unix(handshakeSec, handshakeNsec)
+			peer.LatestHandshake = &handshake
+		}
+		handshakeSec, handshakeNsec = 0, 0
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(ipc))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "private_key":
+			status.PublicKey, _ = PublicKey(hexToBase64(value))
+		case "listen_port":
+			status.ListenPort, _ = strconv.Atoi(value)
+		case "public_key":
+			finishPeer()
+			status.Peers = append(status.Peers, PeerStatus{PublicKey: hexToBase64(value), AllowedIPs: []string{}})
+			peer = &status.Peers[len(status.Peers)-1]
+		}
+		if peer == nil {
+			continue
+		}
+
+		switch key {
+		case "endpoint":
+			peer.Endpoint = value
+		case "allowed_ip":
+			peer.AllowedIPs = append(peer.AllowedIPs, value)
+		case "last_handshake_time_sec":
+			handshakeSec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			handshakeNsec, _ = strconv.ParseInt(value, 10, 64)
+		case "rx_bytes":
+			peer.ReceivedBytes, _ = strconv.ParseInt(value, 10, 64)
+		case "tx_bytes":
+			peer.SentBytes, _ = strconv.ParseInt(value, 10, 64)
+		case "persistent_keepalive_interval":
+			peer.PersistentKeepalive, _ = strconv.Atoi(value)
+		}
+	}
+	finishPeer()
+	return status
+}
+
+// serveStatus reports the status of the tunnel as JSON
+func (d VirtualTun) serveStatus(w http.ResponseWriter) {
+	status, err := d.Status()
+	if err != nil {
+		d.Logger.Errorf("Failed to get status: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		d.Logger.Errorf("Failed to get status: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+	_, _ = w.Write([]byte("\n"))
+}
@@ -0,0 +1,342 @@
+package wireproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	// restartBackoffMin and restartBackoffMax bound the delay before a failed routine is restarted
+	restartBackoffMin = time.Second
+	restartBackoffMax = time.Minute
+	// acceptBackoffMax bounds the delay before accepting again after a temporary error
+	acceptBackoffMax = time.Second
+)
+
+// States of a routine
+const (
+	RoutineRunning    = "running"
+	RoutineRestarting = "restarting"
+	RoutineStopped    = "stopped"
+	// RoutineFailed is a routine which failed and can't be restarted
+	RoutineFailed = "failed"
+)
+
+// RoutineState describes a routine run by a Supervisor
+type RoutineState struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+	Restarts int    `json:"restarts"`
+	// Connections is the number of connections the routine is currently handling
+	Connections int `json:"connections"`
+	// Accepted is the number of connections the routine accepted since it was spawned
+	Accepted int64 `json:"accepted"`
+
+	group *routineGroup
+}
+
+// routineGroup gathers the routines expanded from a single section, which are
+// reported as one routine
+type routineGroup struct {
+	name string
+}
+
+// Supervisor runs routines, and restarts them with backoff when they fail
+type Supervisor struct {
+	lock     sync.Mutex
+	routines []*RoutineState
+	logger   *device.Logger
+}
+
+// NewSupervisor creates a Supervisor without any routine
+func NewSupervisor(logger *device.Logger) *Supervisor {
+	return &Supervisor{logger: logger}
+}
+
+// routineName describes a routine by its section and address
+func routineName(spawner RoutineSpawner) string {
+	switch config := spawner.(type) {
+	case *TCPClientTunnelConfig:
+		return "TCPClientTunnel " + listenerName(config.bindAddress(), config.SystemdSocket)
+	case *STDIOTunnelConfig:
+		return "STDIOTunnel " + config.Target
+	case *TCPServerTunnelConfig:
+		return fmt.Sprintf("TCPServerTunnel %d", config.ListenPort)
+	case *Socks5Config:
+		return "Socks5 " + listenerName(config.BindAddress, config.SystemdSocket)
+	case *HTTPConfig:
+		return "http " + listenerName(config.BindAddress, config.SystemdSocket)
+	case *Socks5ServerConfig:
+		return fmt.Sprintf("Socks5Server %d", config.ListenPort)
+	case *HTTPServerConfig:
+		return fmt.Sprintf("HTTPServer %d", config.ListenPort)
+	case *TransparentProxyConfig:
+		return "TransparentProxy " + config.BindAddress
+	default:
+		return fmt.Sprintf("%T", spawner)
+	}
+}
+
+// groupOf returns the group of the routines expanded from the same section as `spawner`, if any
+func groupOf(spawner RoutineSpawner) *routineGroup {
+	switch config := spawner.(type) {
+	case *TCPClientTunnelConfig:
+		return config.group
+	case *TCPServerTunnelConfig:
+		return config.group
+	default:
+		return nil
+	}
+}
+
+// restartable checks whether `spawner` can run again after failing. A STDIOTunnel
+// can't, as its standard input and output are closed once it ran.
+func restartable(spawner RoutineSpawner) bool {
+	_, isStdio := spawner.(*STDIOTunnelConfig)
+	return !isStdio
+}
+
+// listenerName describes where a routine listens
+func listenerName(bindAddress, systemdSocket string) string {
+	if systemdSocket != "" {
+		return "systemd:" + systemdSocket
+	}
+	return bindAddress
+}
+
+func (s *Supervisor) update(state *RoutineState, f func(state *RoutineState)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f(state)
+}
+
+// Spawn runs `spawner` in the background until `ctx` is done. Whenever it fails, it is restarted after
+// a delay which doubles on every consecutive failure. A routine returning without error is not restarted.
+func (s *Supervisor) Spawn(ctx context.Context, vt *VirtualTun, spawner RoutineSpawner) {
+	state := &RoutineState{Name: routineName(spawner), State: RoutineRunning, group: groupOf(spawner)}
+	s.lock.Lock()
+	s.routines = append(s.routines, state)
+	s.lock.Unlock()
+
+	ctx = context.WithValue(ctx, routineKey{}, &routineTracker{supervisor: s, state: state})
+	go func() {
+		backoff := restartBackoffMin
+		for {
+			started := time.Now()
+			err := spawner.SpawnRoutine(ctx, vt)
+			if err == nil || ctx.Err() != nil {
+				s.update(state, func(state *RoutineState) {
+					state.State = RoutineStopped
+					state.Error = ""
+				})
+				return
+			}
+
+			if !restartable(spawner) {
+				s.logger.Errorf("%s failed: %s", state.Name, err.Error())
+				s.update(state, func(state *RoutineState) {
+					state.State = RoutineFailed
+					state.Error = err.Error()
+				})
+				return
+			}
+
+			// a routine which ran for a while before failing is restarted quickly
+			if time.Since(started) > restartBackoffMax {
+				backoff = restartBackoffMin
+			}
+
+			s.logger.Errorf("%s failed, restarting in %s: %s", state.Name, backoff, err.Error())
+			s.update(state, func(state *RoutineState) {
+				state.State = RoutineRestarting
+				state.Error = err.Error()
+			})
+
+			select {
+			case <-ctx.Done():
+				s.update(state, func(state *RoutineState) {
+					state.State = RoutineStopped
+				})
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, restartBackoffMax)
+
+			s.update(state, func(state *RoutineState) {
+				state.State = RoutineRunning
+				state.Restarts++
+			})
+		}
+	}()
+}
+
+// States returns a snapshot of the state of every routine. The routines of a group are
+// added up in a single state, which is restarting if any of them is.
+func (s *Supervisor) States() []RoutineState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	states := make([]RoutineState, 0, len(s.routines))
+	groups := make(map[*routineGroup]int)
+	for _, state := range s.routines {
+		if state.group == nil {
+			states = append(states, *state)
+			continue
+		}
+		i, ok := groups[state.group]
+		if !ok {
+			groups[state.group] = len(states)
+			merged := *state
+			merged.Name = state.group.name
+			states = append(states, merged)
+			continue
+		}
+
+		merged := &states[i]
+		if merged.State != RoutineRestarting && state.State != RoutineStopped {
+			merged.State = state.State
+		}
+		if merged.Error == "" {
+			merged.Error = state.Error
+		}
+		merged.Restarts += state.Restarts
+		merged.Connections += state.Connections
+		merged.Accepted += state.Accepted
+	}
+	return states
+}
+
+// Healthy checks whether no routine failed or is waiting to be restarted
+func (s *Supervisor) Healthy() bool {
+	for _, state := range s.States() {
+		if state.State == RoutineRestarting || state.State == RoutineFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP reports the state of every routine as JSON
+func (s *Supervisor) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	body, err := json.Marshal(s.States())
+	if err != nil {
+		s.logger.Errorf("Failed to get routines: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if !s.Healthy() {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+	_, _ = w.Write([]byte("\n"))
+}
+
+// routineKey is the key of the routineTracker in the context of a routine
+type routineKey struct{}
+
+// routineTracker counts the connections of a routine in its state
+type routineTracker struct {
+	supervisor *Supervisor
+	state      *RoutineState
+}
+
+// trackConnection counts a connection accepted by the routine running with `ctx`,
+// and returns the function to call once the connection is closed
+func trackConnection(ctx context.Context) func() {
+	tracker, ok := ctx.Value(routineKey{}).(*routineTracker)
+	if !ok {
+		return func() {}
+	}
+
+	tracker.supervisor.update(tracker.state, func(state *RoutineState) {
+		state.Connections++
+		state.Accepted++
+	})
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			tracker.supervisor.update(tracker.state, func(state *RoutineState) {
+				state.Connections--
+			})
+		})
+	}
+}
+
+// trackedListener counts the connections it accepts in the state of a routine
+type trackedListener struct {
+	net.Listener
+	ctx context.Context
+}
+
+// trackConnections wraps `l` so that its connections are counted in the state of
+// the routine running with `ctx`
+func trackConnections(ctx context.Context, l net.Listener) net.Listener {
+	return trackedListener{Listener: l, ctx: ctx}
+}
+
+func (l trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &trackedConn{Conn: conn, release: trackConnection(l.ctx)}, nil
+}
+
+// trackedConn stops being counted once closed
+type trackedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *trackedConn) CloseWrite() error {
+	return closeWrite(c.Conn, c)
+}
+
+func (c *trackedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+// retryListener retries accepting connections after temporary errors, e.g. when
+// running out of file descriptors, instead of failing
+type retryListener struct {
+	net.Listener
+	logger *device.Logger
+}
+
+func (l retryListener) Accept() (net.Conn, error) {
+	var backoff time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+
+		var temporary interface{ Temporary() bool }
+		if !errors.As(err, &temporary) || !temporary.Temporary() {
+			return nil, err
+		}
+
+		if backoff == 0 {
+			backoff = 5 * time.Millisecond
+		} else {
+			backoff = min(backoff*2, acceptBackoffMax)
+		}
+		l.logger.Errorf("Accept error, retrying in %s: %s", backoff, err.Error())
+		time.Sleep(backoff)
+	}
+}
@@ -0,0 +1,42 @@
+package wireproxy
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// inheritedSockets are the sockets passed by systemd socket activation, by their
+// FileDescriptorName. The environment is cleared so that they aren't passed on to children.
+var inheritedSockets = sync.OnceValue(func() map[string]*os.File {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	sockets := make(map[string]*os.File)
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return sockets
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return sockets
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < count; i++ {
+		// systemd names sockets without a FileDescriptorName "unknown"
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		fd := listenFDsStart + i
+		sockets[name] = os.NewFile(uintptr(fd), name)
+	}
+	return sockets
+})
@@ -1,8 +1,8 @@
 #!/usr/bin/env bash
 set -e
 exec 3<>/dev/tcp/demo.wireguard.com/42912
-privatekey="$(wg genkey)"
-wg pubkey <<<"$privatekey" >&3
+privatekey="$(./wireproxy genkey)"
+./wireproxy pubkey <<<"$privatekey" >&3
 IFS=: read -r status server_pubkey server_port internal_ip <&3
 [[ $status == OK ]]
 cat >test.conf <<EOL
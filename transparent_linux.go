@@ -0,0 +1,318 @@
+//go:build linux
+
+package wireproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	// SO_ORIGINAL_DST from linux/netfilter_ipv4.h
+	soOriginalDst = 80
+	// IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h
+	ip6tSoOriginalDst = 80
+)
+
+// udpSessionTimeout is how long an idle UDP association is kept before it is closed
+const udpSessionTimeout = 60 * time.Second
+
+// transparentControl marks a socket as transparent so it can accept traffic
+// redirected by TPROXY and bind to non-local addresses
+func transparentControl(network, _ string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		if sockErr != nil {
+			return
+		}
+		// these only apply to IPv6 sockets, and fail harmlessly on IPv4 ones
+		_ = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+
+		switch network {
+		case "udp", "udp4", "udp6":
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+			if sockErr != nil {
+				return
+			}
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+			_ = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// originalDst recovers the destination of a connection redirected by iptables/nftables REDIRECT
+func originalDst(conn *net.TCPConn) (netip.AddrPort, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	local := conn.LocalAddr().(*net.TCPAddr).AddrPort()
+
+	var dst netip.AddrPort
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local.Addr().Unmap().Is4() {
+			// the kernel writes a sockaddr_in into the buffer
+			var mreq *unix.IPv6Mreq
+			mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if sockErr != nil {
+				return
+			}
+			port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+			dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(mreq.Multiaddr[4:8])), port)
+		} else {
+			// the kernel writes a sockaddr_in6 into the buffer
+			var info *unix.IPv6MTUInfo
+			info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst)
+			if sockErr != nil {
+				return
+			}
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), binary.BigEndian.Uint16(port[:]))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return dst, sockErr
+}
+
+// parseOriginalDst extracts the original destination from the ancillary data of a TPROXY UDP packet
+func parseOriginalDst(oob []byte) (netip.AddrPort, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR && len(msg.Data) >= 8:
+			port := binary.BigEndian.Uint16(msg.Data[2:4])
+			return netip.AddrPortFrom(netip.AddrFrom4([4]byte(msg.Data[4:8])), port), nil
+		case msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR && len(msg.Data) >= 24:
+			port := binary.BigEndian.Uint16(msg.Data[2:4])
+			return netip.AddrPortFrom(netip.AddrFrom16([16]byte(msg.Data[8:24])), port), nil
+		}
+	}
+
+	return netip.AddrPort{}, errors.New("original destination not found")
+}
+
+// transparentTCPForward forwards a redirected TCP connection to its original destination via wireguard
+func transparentTCPForward(vt *VirtualTun, conn *net.TCPConn, tproxy bool, timeouts ConnTimeouts) {
+	var target netip.AddrPort
+	if tproxy {
+		// TPROXY keeps the original destination as the local address of the socket
+		target = conn.LocalAddr().(*net.TCPAddr).AddrPort()
+	} else {
+		var err error
+		target, err = originalDst(conn)
+		if err != nil {
+			vt.Logger.Errorf("Transparent proxy cannot get original destination: %s", err.Error())
+			_ = conn.Close()
+			return
+		}
+	}
+	target = netip.AddrPortFrom(target.Addr().Unmap(), target.Port())
+
+	sconn, err := vt.DialContextTCPAddrPort(context.Background(), target)
+	if err != nil {
+		vt.Logger.Errorf("Transparent proxy to %s: %s", target, err.Error())
+		_ = conn.Close()
+		return
+	}
+
+	connForward(conn, sconn, vt.forwardBufferSize(), timeouts, vt.Logger)
+}
+
+// udpSession associates a client with one original destination
+type udpSession struct {
+	tunnel net.Conn
+	reply  *net.UDPConn
+	logger *device.Logger
+	closed atomic.Bool
+}
+
+// close closes the sockets of the session, which ends its relay
+func (s *udpSession) close() {
+	s.closed.Store(true)
+	_ = s.tunnel.Close()
+	_ = s.reply.Close()
+}
+
+// serveUDP accepts UDP packets redirected by TPROXY and relays them via wireguard, until `conn`
+// is closed. The sessions are closed along with it, rather than once they idle out, so that
+// their transparent sockets don't outlive the routine.
+func (config *TransparentProxyConfig) serveUDP(vt *VirtualTun, conn *net.UDPConn) error {
+	var lock sync.Mutex
+	sessions := make(map[string]*udpSession)
+	defer func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, session := range sessions {
+			session.close()
+		}
+	}()
+
+	buf := make([]byte, 65535)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, src, err := conn.ReadMsgUDPAddrPort(buf, oob)
+		if err != nil {
+			return err
+		}
+
+		dst, err := parseOriginalDst(oob[:oobn])
+		if err != nil {
+			vt.Logger.Errorf("Transparent proxy cannot get original destination: %s", err.Error())
+			continue
+		}
+		dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+		if dst.Addr().Is4() {
+			src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		}
+
+		key := src.String() + "|" + dst.String()
+		lock.Lock()
+		session, ok := sessions[key]
+		if !ok {
+			session, err = newUDPSession(vt, dst)
+			if err != nil {
+				lock.Unlock()
+				vt.Logger.Errorf("Transparent proxy to %s: %s", dst, err.Error())
+				continue
+			}
+			sessions[key] = session
+			go func() {
+				session.relay(src)
+				lock.Lock()
+				delete(sessions, key)
+				lock.Unlock()
+			}()
+		}
+		lock.Unlock()
+
+		_ = session.tunnel.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		if _, err := session.tunnel.Write(buf[:n]); err != nil {
+			vt.Logger.Errorf("Transparent proxy to %s: %s", dst, err.Error())
+		}
+	}
+}
+
+// newUDPSession opens a tunnel connection to `dst` and a socket which
+// sends replies back to the client from `dst`
+func newUDPSession(vt *VirtualTun, dst netip.AddrPort) (*udpSession, error) {
+	tunnel, err := vt.Tnet.DialUDPAddrPort(netip.AddrPort{}, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	network := "udp6"
+	if dst.Addr().Is4() {
+		network = "udp4"
+	}
+	lc := net.ListenConfig{Control: transparentControl}
+	reply, err := lc.ListenPacket(context.Background(), network, dst.String())
+	if err != nil {
+		_ = tunnel.Close()
+		return nil, err
+	}
+
+	return &udpSession{tunnel: tunnel, reply: reply.(*net.UDPConn), logger: vt.Logger}, nil
+}
+
+// relay copies replies from the tunnel to `client` until the session idles out or is closed
+func (s *udpSession) relay(client netip.AddrPort) {
+	defer s.close()
+
+	buf := make([]byte, 65535)
+	for {
+		_ = s.tunnel.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		n, err := s.tunnel.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if !s.closed.Load() && (!errors.As(err, &netErr) || !netErr.Timeout()) {
+				s.logger.Errorf("Transparent proxy cannot read from tunnel: %s", err.Error())
+			}
+			return
+		}
+
+		if _, err := s.reply.WriteToUDPAddrPort(buf[:n], client); err != nil {
+			s.logger.Errorf("Transparent proxy cannot reply to %s: %s", client, err.Error())
+			return
+		}
+	}
+}
+
+// SpawnRoutine spawns a transparent proxy which forwards traffic redirected by
+// iptables/nftables to its original destination via wireguard
+func (config *TransparentProxyConfig) SpawnRoutine(ctx context.Context, vt *VirtualTun) error {
+	tproxy := config.Mode == "tproxy"
+
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = transparentControl
+	}
+
+	server, err := lc.Listen(context.Background(), "tcp", config.BindAddress)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	stop := context.AfterFunc(ctx, func() { _ = server.Close() })
+	defer stop()
+
+	// closing both sockets on return stops the other one from being served
+	errs := make(chan error, 2)
+	if config.UDP {
+		pc, err := lc.ListenPacket(context.Background(), "udp", config.BindAddress)
+		if err != nil {
+			return err
+		}
+		defer pc.Close()
+		stopUDP := context.AfterFunc(ctx, func() { _ = pc.Close() })
+		defer stopUDP()
+		go func() {
+			errs <- config.serveUDP(vt, pc.(*net.UDPConn))
+		}()
+	}
+
+	go func() {
+		listener := retryListener{server, vt.Logger}
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				errs <- err
+				return
+			}
+			release := trackConnection(ctx)
+			go func() {
+				defer release()
+				transparentTCPForward(vt, conn.(*net.TCPConn), tproxy, config.ConnTimeouts)
+			}()
+		}
+	}()
+
+	err = <-errs
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
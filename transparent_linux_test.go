@@ -0,0 +1,105 @@
+//go:build linux
+
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/pufferffish/wireproxy/internal/netstack"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// controlMessage builds the ancillary data of a single control message
+func controlMessage(level, typ int32, data []byte) []byte {
+	oob := make([]byte, unix.CmsgSpace(len(data)))
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = level
+	header.Type = typ
+	header.SetLen(unix.CmsgLen(len(data)))
+	copy(oob[unix.CmsgLen(0):], data)
+	return oob
+}
+
+func TestParseOriginalDst(t *testing.T) {
+	// sockaddr_in of 192.0.2.1:53, the port in network byte order
+	sockaddr4 := []byte{unix.AF_INET, 0, 0, 53, 192, 0, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	dst, err := parseOriginalDst(controlMessage(unix.SOL_IP, unix.IP_ORIGDSTADDR, sockaddr4))
+	if err != nil || dst != netip.MustParseAddrPort("192.0.2.1:53") {
+		t.Errorf("unexpected destination %s, %v", dst, err)
+	}
+
+	// sockaddr_in6 of [2001:db8::1]:443
+	sockaddr6 := make([]byte, 28)
+	sockaddr6[0] = unix.AF_INET6
+	sockaddr6[2], sockaddr6[3] = 1, 187
+	copy(sockaddr6[8:24], netip.MustParseAddr("2001:db8::1").AsSlice())
+	dst, err = parseOriginalDst(controlMessage(unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR, sockaddr6))
+	if err != nil || dst != netip.MustParseAddrPort("[2001:db8::1]:443") {
+		t.Errorf("unexpected destination %s, %v", dst, err)
+	}
+
+	if _, err := parseOriginalDst(controlMessage(unix.SOL_IP, unix.IP_TTL, []byte{64, 0, 0, 0})); err == nil {
+		t.Error("expected a missing original destination to fail")
+	}
+}
+
+func TestTransparentUDPSessionsClosed(t *testing.T) {
+	lc := net.ListenConfig{Control: transparentControl}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("transparent sockets require CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().(*net.UDPAddr)
+
+	tunDev, tnet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.2")}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vt := &VirtualTun{Tnet: tnet, Logger: device.NewLogger(device.LogLevelSilent, "")}
+	done := make(chan error, 1)
+	go func() {
+		done <- (&TransparentProxyConfig{}).serveUDP(vt, pc.(*net.UDPConn))
+	}()
+
+	client, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the packet reaches the tunnel once the session is opened
+	read := make(chan error, 1)
+	go func() {
+		_, err := tunDev.Read([][]byte{make([]byte, 1500)}, []int{0}, 0)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the packet to be relayed")
+	}
+
+	_ = pc.Close()
+	<-done
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		t.Fatalf("expected the sessions to be closed with the listener: %v", err)
+	}
+	_ = conn.Close()
+}
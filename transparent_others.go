@@ -0,0 +1,13 @@
+//go:build !linux
+
+package wireproxy
+
+import (
+	"context"
+	"errors"
+)
+
+// SpawnRoutine fails as transparent proxying relies on Linux netfilter
+func (config *TransparentProxyConfig) SpawnRoutine(_ context.Context, _ *VirtualTun) error {
+	return errors.New("transparent proxy is only supported on Linux")
+}
@@ -0,0 +1,35 @@
+package wireproxy
+
+// ServeUAPI serves the wireguard UAPI on the unix socket of `conf` until the tunnel is closed,
+// so that wg show, wg set and wg syncconf can manage the device
+func (d *VirtualTun) ServeUAPI(conf *UAPIConfig) error {
+	perms := SocketPermissions{SocketMode: conf.Mode, SocketUID: -1, SocketGID: conf.GID}
+	if conf.Group != "" {
+		perms.SocketOwner = ":" + conf.Group
+	}
+	listener, err := listenUnix(conf.Socket, perms)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-d.done
+		_ = listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-d.done:
+				default:
+					d.Logger.Errorf("UAPI socket %s stopped: %s", conf.Socket, err.Error())
+				}
+				return
+			}
+			go d.Dev.IpcHandle(conn)
+		}
+	}()
+	return nil
+}
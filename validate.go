@@ -0,0 +1,511 @@
+package wireproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// ConfigError is a problem in a configuration, located as precisely as possible.
+// Line numbers are only known for configurations in the INI format.
+type ConfigError struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Section string `json:"section,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Message string `json:"message"`
+
+	section *ini.Section
+	located bool
+}
+
+func (e *ConfigError) Error() string {
+	location := e.File
+	if e.Line > 0 {
+		if location == "" {
+			location = "line " + strconv.Itoa(e.Line)
+		} else {
+			location += ":" + strconv.Itoa(e.Line)
+		}
+	}
+
+	var b strings.Builder
+	if location != "" {
+		b.WriteString(location + ": ")
+	}
+	if e.Section != "" {
+		b.WriteString("[" + e.Section + "] ")
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+// keyError attributes an error to the key `keyName`
+func keyError(keyName string, err error) error {
+	var configErr *ConfigError
+	if errors.As(err, &configErr) {
+		return err
+	}
+
+	message := err.Error()
+	if !strings.Contains(message, keyName) {
+		message = keyName + ": " + message
+	}
+	return &ConfigError{Key: keyName, Message: message}
+}
+
+// sectionError attributes an error to `section`
+func sectionError(section *ini.Section, err error) error {
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		configErr = &ConfigError{Message: err.Error()}
+	}
+	if configErr.section == nil {
+		configErr.section = section
+		if section.Name() != ini.DefaultSection {
+			configErr.Section = sectionName(section)
+		}
+	}
+	return configErr
+}
+
+// singleSectionError attributes an error to the section `name` which should appear at most once,
+// or to its last occurrence if it appears several times
+func singleSectionError(cfg *ini.File, name string, err error) error {
+	sections, _ := cfg.SectionsByName(name)
+	if len(sections) == 0 {
+		return err
+	}
+	return sectionError(sections[len(sections)-1], err)
+}
+
+// sectionLines are the line numbers of a section and of its keys
+type sectionLines struct {
+	line int
+	keys map[string]int
+}
+
+// configSource is where a configuration was loaded from, to locate its errors
+type configSource struct {
+	path string
+	// lines are the sections by lower case name in order of appearance,
+	// nil for formats without line numbers
+	lines map[string][]sectionLines
+}
+
+// newConfigSource indexes the sections and keys of a configuration in `format`
+func newConfigSource(path string, data []byte, format string) *configSource {
+	source := &configSource{path: path}
+	if format != FormatINI {
+		return source
+	}
+
+	source.lines = make(map[string][]sectionLines)
+	current := sectionLines{keys: make(map[string]int)}
+	name := strings.ToLower(ini.DefaultSection)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+
+		if text[0] == '[' {
+			source.lines[name] = append(source.lines[name], current)
+			end := strings.IndexByte(text, ']')
+			if end < 0 {
+				end = len(text)
+			}
+			name = strings.ToLower(strings.TrimSpace(text[1:end]))
+			current = sectionLines{line: line, keys: make(map[string]int)}
+			continue
+		}
+
+		if i := strings.IndexAny(text, "=:"); i > 0 {
+			key := strings.ToLower(strings.TrimSpace(text[:i]))
+			if _, ok := current.keys[key]; !ok {
+				current.keys[key] = line
+			}
+		}
+	}
+	source.lines[name] = append(source.lines[name], current)
+	return source
+}
+
+// locate fills in where an error of the configuration `cfg` is in its source
+func (s *configSource) locate(cfg *ini.File, err error) *ConfigError {
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		configErr = &ConfigError{Message: err.Error()}
+	}
+	if configErr.located {
+		return configErr
+	}
+	configErr.located = true
+	configErr.File = s.path
+
+	if configErr.section != nil && cfg != nil {
+		configErr.Line = s.line(cfg, configErr.section, configErr.Key)
+	}
+	return configErr
+}
+
+// line returns the line number of `keyName` in `section`, or of the section itself
+// if the key is not set. It returns 0 if unknown.
+func (s *configSource) line(cfg *ini.File, section *ini.Section, keyName string) int {
+	name := strings.ToLower(section.Name())
+	sections, _ := cfg.SectionsByName(section.Name())
+	index := 0
+	for i, other := range sections {
+		if other == section {
+			index = i
+		}
+	}
+
+	if index >= len(s.lines[name]) {
+		return 0
+	}
+	lines := s.lines[name][index]
+	if line, ok := lines.keys[strings.ToLower(keyName)]; ok {
+		return line
+	}
+	return lines.line
+}
+
+// describe names a section for messages, with its line number if known
+func (s *configSource) describe(cfg *ini.File, section *ini.Section) string {
+	description := "[" + sectionName(section) + "]"
+	if line := s.line(cfg, section, ""); line > 0 {
+		description += " on line " + strconv.Itoa(line)
+	}
+	return description
+}
+
+var (
+	connTimeoutsKeys  = []string{"IdleTimeout", "MaxLifetime"}
+	connLimitsKeys    = []string{"MaxConnections", "MaxConnectionsPerIP", "ConnectionRate", "Bandwidth", "ConnectionBandwidth"}
+	quotaKeys         = []string{"DailyQuota", "MonthlyQuota"}
+	socketKeys        = []string{"SocketMode", "SocketOwner"}
+	loadBalancingKeys = []string{"Balance", "HealthCheckInterval", "HealthCheckTimeout"}
+)
+
+// knownKeys are the keys of every section, keys outside of any section are in the default section
+var knownKeys = map[string][]string{
+	ini.DefaultSection: {"WGConfig"},
+	"Interface": {
+		"Address", "PrivateKey", "PrivateKeyFile", "DNS", "MTU", "MSSClamp", "ListenPort",
+		"CheckAlive", "CheckAliveInterval",
+		// keys of wg-quick, which are ignored
+		"Table", "PreUp", "PostUp", "PreDown", "PostDown", "SaveConfig", "FwMark",
+	},
+	"Peer":             {"PublicKey", "PublicKeyFile", "PreSharedKey", "PreSharedKeyFile", "Endpoint", "PersistentKeepalive", "AllowedIPs"},
+	"TUN":              {"Name", "FD", "Address"},
+	"Capture":          {"File", "Host", "Port", "MaxSize", "Stream"},
+	"Accounting":       {"StateFile"},
+	"UAPI":             {"Socket", "Mode", "Group"},
+	"Netstack":         {"CongestionControl", "SACK", "ModerateReceiveBuffer", "ReceiveBufferMax", "SendBufferMax", "KeepAlive", "KeepAliveInterval", "ForwardBufferSize"},
+	"TCPClientTunnel":  concatKeys([]string{"BindAddress", "SystemdSocket", "Target"}, loadBalancingKeys, connTimeoutsKeys, connLimitsKeys, socketKeys),
+	"STDIOTunnel":      concatKeys([]string{"Target"}, connTimeoutsKeys),
+	"TCPServerTunnel":  concatKeys([]string{"ListenPort", "Target"}, loadBalancingKeys, connTimeoutsKeys, connLimitsKeys),
+	"Socks5":           concatKeys([]string{"BindAddress", "SystemdSocket", "Username", "Password", "PasswordFile"}, connTimeoutsKeys, connLimitsKeys, quotaKeys, socketKeys),
+	"http":             concatKeys([]string{"BindAddress", "SystemdSocket", "Username", "Password", "PasswordFile"}, connTimeoutsKeys, connLimitsKeys, quotaKeys, socketKeys),
+	"Socks5Server":     concatKeys([]string{"ListenPort", "Username", "Password", "PasswordFile", "AllowedIPs", "AllowedPorts"}, connTimeoutsKeys, connLimitsKeys, quotaKeys),
+	"HTTPServer":       concatKeys([]string{"ListenPort", "Username", "Password", "PasswordFile", "AllowedIPs", "AllowedPorts"}, connTimeoutsKeys, connLimitsKeys, quotaKeys),
+	"TransparentProxy": concatKeys([]string{"BindAddress", "Mode", "UDP"}, connTimeoutsKeys),
+}
+
+func concatKeys(keys ...[]string) []string {
+	var all []string
+	for _, k := range keys {
+		all = append(all, k...)
+	}
+	return all
+}
+
+// sectionName returns the name of a section as spelled in the documentation
+func sectionName(section *ini.Section) string {
+	for name := range knownKeys {
+		if strings.EqualFold(name, section.Name()) {
+			return name
+		}
+	}
+	return section.Name()
+}
+
+// checkKeys reports the unknown sections and keys of a configuration
+func checkKeys(cfg *ini.File) []error {
+	var errs []error
+	for _, section := range cfg.Sections() {
+		name := sectionName(section)
+		keys, ok := knownKeys[name]
+		if !ok {
+			errs = append(errs, sectionError(section, errors.New("unknown section")))
+			continue
+		}
+
+	nextKey:
+		for _, key := range section.Keys() {
+			for _, known := range keys {
+				if strings.EqualFold(known, key.Name()) {
+					continue nextKey
+				}
+			}
+			errs = append(errs, sectionError(section, &ConfigError{Key: key.Name(), Message: "unknown key " + key.Name()}))
+		}
+	}
+	return errs
+}
+
+// checkBindAddresses reports listeners which would conflict with each other
+func checkBindAddresses(cfg *ini.File, source *configSource) []error {
+	type listener struct {
+		section *ini.Section
+		host    string
+		ports   []string
+		// socket is the path of unix socket listeners
+		socket string
+	}
+
+	var errs []error
+	var listeners []listener
+	var tunnelPorts []listener
+	for _, section := range cfg.Sections() {
+		switch sectionName(section) {
+		case "TCPClientTunnel", "Socks5", "http", "TransparentProxy":
+			address, err := parseString(section, "BindAddress")
+			if err != nil {
+				continue
+			}
+			current := listener{section: section}
+			if path, ok := strings.CutPrefix(address, "unix:"); ok {
+				current.socket = filepath.Clean(path)
+			} else {
+				host, port, err := net.SplitHostPort(address)
+				if err != nil {
+					continue
+				}
+				current.host, current.ports = strings.ToLower(host), expandPorts(port)
+			}
+
+			for _, other := range listeners {
+				wildcard := isWildcardHost(current.host) || isWildcardHost(other.host)
+				sameSocket := current.socket != "" && current.socket == other.socket
+				samePort := sharePort(current.ports, other.ports) && (current.host == other.host || wildcard)
+				if sameSocket || samePort {
+					err := fmt.Errorf("BindAddress %s conflicts with the BindAddress of %s", address, source.describe(cfg, other.section))
+					errs = append(errs, sectionError(section, keyError("BindAddress", err)))
+					break
+				}
+			}
+			listeners = append(listeners, current)
+		case "TCPServerTunnel", "Socks5Server", "HTTPServer":
+			port, err := parseString(section, "ListenPort")
+			if err != nil {
+				continue
+			}
+			current := listener{section: section, ports: expandPorts(port)}
+
+			for _, other := range tunnelPorts {
+				if sharePort(current.ports, other.ports) {
+					err := fmt.Errorf("ListenPort %s is also used by %s", port, source.describe(cfg, other.section))
+					errs = append(errs, sectionError(section, keyError("ListenPort", err)))
+					break
+				}
+			}
+			tunnelPorts = append(tunnelPorts, current)
+		}
+	}
+	return errs
+}
+
+// expandPorts lists the ports of a listener, whose port may be a list of ports
+func expandPorts(port string) []string {
+	if port == "" {
+		return nil
+	}
+	if !isPortList(port) {
+		return []string{port}
+	}
+	list, err := parsePortList(port)
+	if err != nil {
+		return nil
+	}
+	ports := make([]string, 0, len(list))
+	for _, port := range list {
+		ports = append(ports, strconv.Itoa(port))
+	}
+	return ports
+}
+
+// sharePort checks whether two listeners have a port in common
+func sharePort(a, b []string) bool {
+	for _, port := range a {
+		if slices.Contains(b, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWildcardHost checks whether a listener on `host` accepts connections on every address
+func isWildcardHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsUnspecified()
+}
+
+// checkPeers reports overlapping AllowedIPs between peers, and CheckAlive addresses
+// which would not be routed to any peer
+func checkPeers(wgCfg *ini.File, source *configSource, device *DeviceConfig) []error {
+	var errs []error
+	sections, _ := wgCfg.SectionsByName("Peer")
+	if len(sections) != len(device.Peers) {
+		return nil
+	}
+
+	for i, peer := range device.Peers {
+	nextPrefix:
+		for _, prefix := range peer.routedIPs() {
+			for j := 0; j < i; j++ {
+				for _, other := range device.Peers[j].routedIPs() {
+					if prefix.Overlaps(other) {
+						err := fmt.Errorf("AllowedIPs %s overlaps with %s of %s", prefix, other, source.describe(wgCfg, sections[j]))
+						errs = append(errs, sectionError(sections[i], keyError("AllowedIPs", err)))
+						continue nextPrefix
+					}
+				}
+			}
+		}
+	}
+
+	interfaces, _ := wgCfg.SectionsByName("Interface")
+	if len(interfaces) != 1 {
+		return errs
+	}
+nextAddr:
+	for _, addr := range device.CheckAlive {
+		for _, peer := range device.Peers {
+			for _, prefix := range peer.routedIPs() {
+				if prefix.Contains(addr) {
+					continue nextAddr
+				}
+			}
+		}
+		err := fmt.Errorf("CheckAlive address %s is outside of the AllowedIPs of every peer", addr)
+		errs = append(errs, sectionError(interfaces[0], keyError("CheckAlive", err)))
+	}
+	return errs
+}
+
+// CheckConfig parses the configuration file at `path` like ParseConfig, and also looks for
+// mistakes ParseConfig lets through: unknown sections and keys, listeners conflicting with
+// each other, overlapping AllowedIPs between peers and CheckAlive addresses outside of any
+// AllowedIPs. It returns every problem found.
+func CheckConfig(path string) []*ConfigError {
+	return CheckConfigFile(path, FormatFromPath(path))
+}
+
+// CheckConfigFile checks the configuration file at `path` in `format` like CheckConfig
+func CheckConfigFile(path string, format string) []*ConfigError {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []*ConfigError{{File: path, Message: err.Error()}}
+	}
+
+	return checkConfig(data, newConfigSource(path, data, format), format)
+}
+
+// CheckConfigFormat reads a configuration in `format` until EOF and checks it like CheckConfig
+func CheckConfigFormat(r io.Reader, format string) []*ConfigError {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return []*ConfigError{{Message: err.Error()}}
+	}
+
+	return checkConfig(data, newConfigSource("", data, format), format)
+}
+
+// placeholderKey stands for the keys read from commands while checking a configuration
+const placeholderKey = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+// secretKeys are the keys which can also be given as the path of a file with the File suffix
+var secretKeys = []string{"privatekey", "publickey", "presharedkey", "password"}
+
+// placeholder stands for the value of key `name` read from a command while checking a configuration
+func placeholder(name string) string {
+	if strings.HasSuffix(name, "key") {
+		return placeholderKey
+	}
+	return "placeholder"
+}
+
+// stubCommands replaces the exec: references of `cfg` so that they are not run, with a
+// placeholder which parses. A secret whose file comes from a command, such as
+// PrivateKeyFile = exec:..., is replaced by the secret itself.
+func stubCommands(cfg *ini.File) {
+	for _, section := range cfg.Sections() {
+		for _, key := range section.Keys() {
+			if !strings.HasPrefix(strings.TrimSpace(key.String()), "exec:") {
+				continue
+			}
+			secret, isFile := strings.CutSuffix(key.Name(), "file")
+			if isFile && slices.Contains(secretKeys, secret) && !section.HasKey(secret) {
+				section.DeleteKey(key.Name())
+				_, _ = section.NewKey(secret, placeholder(secret))
+				continue
+			}
+			key.SetValue(placeholder(key.Name()))
+		}
+	}
+}
+
+func checkConfig(data []byte, source *configSource, format string) []*ConfigError {
+	cfg, err := loadConfig(data, format)
+	if err != nil {
+		return []*ConfigError{source.locate(nil, err)}
+	}
+
+	var configErrs []*ConfigError
+	report := func(cfg *ini.File, source *configSource, errs ...error) {
+		for _, err := range errs {
+			configErrs = append(configErrs, source.locate(cfg, err))
+		}
+	}
+
+	report(cfg, source, checkKeys(cfg)...)
+	wgCfg, wgSource, err := loadWGConfig(cfg, source)
+	if err != nil {
+		report(cfg, source, err)
+		return configErrs
+	}
+	if wgCfg != cfg {
+		report(wgCfg, wgSource, checkKeys(wgCfg)...)
+	}
+
+	// a configuration test doesn't run commands
+	stubCommands(cfg)
+	stubCommands(wgCfg)
+	conf, err := parseConfigFiles(cfg, source, wgCfg, wgSource)
+	if err != nil {
+		// parseConfig located the error already
+		report(nil, source, err)
+		return configErrs
+	}
+
+	report(cfg, source, checkBindAddresses(cfg, source)...)
+	report(wgCfg, wgSource, checkPeers(wgCfg, wgSource, conf.Device)...)
+	return configErrs
+}
@@ -8,9 +8,10 @@ import (
 	"net/netip"
 
 	"github.com/MakeNowJust/heredoc/v2"
+	"github.com/pufferffish/wireproxy/internal/netstack"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
-	"golang.zx2c4.com/wireguard/tun/netstack"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
 // DeviceSetting contains the parameters for setting up a tun interface
@@ -43,15 +44,8 @@ func CreateIPCRequest(conf *DeviceConfig) (*DeviceSetting, error) {
 			request.WriteString(fmt.Sprintf("endpoint=%s\n", *peer.Endpoint))
 		}
 
-		if len(peer.AllowedIPs) > 0 {
-			for _, ip := range peer.AllowedIPs {
-				request.WriteString(fmt.Sprintf("allowed_ip=%s\n", ip.String()))
-			}
-		} else {
-			request.WriteString(heredoc.Doc(`
-				allowed_ip=0.0.0.0/0
-				allowed_ip=::0/0
-			`))
+		for _, ip := range peer.routedIPs() {
+			request.WriteString(fmt.Sprintf("allowed_ip=%s\n", ip.String()))
 		}
 	}
 
@@ -61,16 +55,79 @@ func CreateIPCRequest(conf *DeviceConfig) (*DeviceSetting, error) {
 
 // StartWireguard creates a tun interface on netstack given a configuration
 func StartWireguard(conf *DeviceConfig, logLevel int) (*VirtualTun, error) {
+	logger := device.NewLogger(logLevel, "")
+	return startWireguard(conf, logger, logger)
+}
+
+// startWireguard creates the tunnel, wireproxy logs to `logger` and the wireguard device to `deviceLogger`
+func startWireguard(conf *DeviceConfig, logger, deviceLogger *device.Logger) (_ *VirtualTun, err error) {
 	setting, err := CreateIPCRequest(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	tun, tnet, err := netstack.CreateNetTUN(setting.DeviceAddr, setting.DNS, setting.MTU)
+	tunDev, tnet, err := netstack.CreateNetTUN(setting.DeviceAddr, setting.DNS, setting.MTU)
+	if err != nil {
+		return nil, err
+	}
+
+	// close what was opened so far when the tunnel can't be brought up,
+	// the wireguard device takes over closing tunDev once created
+	capture := NewPacketCapture(logger)
+	var dev *device.Device
+	defer func() {
+		if err == nil {
+			return
+		}
+		if dev != nil {
+			dev.Close()
+		} else {
+			_ = tunDev.Close()
+		}
+		capture.Close()
+	}()
+
+	var netStack *stack.Stack
+	if conf.Netstack != nil {
+		netStack = tnet.Stack()
+		err = applyNetstackConfig(netStack, conf.Netstack)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.TUN != nil {
+		host, err := openHostTUN(conf.TUN, setting.MTU)
+		if err != nil {
+			return nil, err
+		}
+		tunDev = newBridgeTUN(tunDev, host, conf.TUN.Address, logger)
+	}
+
+	var mssClamp *mssClampTUN
+	if conf.MTUDiscovery || conf.MSSClamp > 0 {
+		mssClamp = newMSSClampTUN(tunDev, uint16(conf.MSSClamp), setting.MTU)
+		tunDev = mssClamp
+	}
+
+	if conf.Capture != nil && conf.Capture.File != "" {
+		err = capture.StartFile(conf.Capture.File, conf.Capture.Filter, conf.Capture.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tunDev = &captureTUN{Device: tunDev, capture: capture}
+
+	var stateFile string
+	if conf.Accounting != nil {
+		stateFile = conf.Accounting.StateFile
+	}
+	accounting, err := NewAccounting(stateFile, logger)
 	if err != nil {
 		return nil, err
 	}
-	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(logLevel, ""))
+
+	dev = device.NewDevice(tunDev, conn.NewDefaultBind(), deviceLogger)
 	err = dev.IpcSet(setting.IpcRequest)
 	if err != nil {
 		return nil, err
@@ -80,13 +137,38 @@ func StartWireguard(conf *DeviceConfig, logLevel int) (*VirtualTun, error) {
 	if err != nil {
 		return nil, err
 	}
+	done := make(chan struct{})
+	accounting.StartSaving(done)
 
 	return &VirtualTun{
 		Tnet:           tnet,
 		Dev:            dev,
 		Conf:           conf,
+		Capture:        capture,
+		Accounting:     accounting,
+		Routines:       NewSupervisor(logger),
+		Logger:         logger,
+		done:           done,
+		mssClamp:       mssClamp,
+		stack:          netStack,
 		SystemDNS:      len(setting.DNS) == 0,
 		PingRecord:     make(map[string]uint64),
 		PingRecordLock: new(sync.Mutex),
 	}, nil
 }
+
+// Close stops the background tasks of the tunnel, saves the usage of its users and
+// shuts down the wireguard device, which closes the connections going through it
+func (d *VirtualTun) Close() error {
+	select {
+	case <-d.done:
+		return nil
+	default:
+		close(d.done)
+	}
+
+	err := d.Accounting.Save()
+	d.Dev.Close()
+	d.Capture.Close()
+	return err
+}